@@ -1,15 +1,116 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"errors"
+	"sort"
 	"strings"
 )
 
-var mnemonics []string = []string{"HLT", "AND", "ANDIB", "ANDIW", "OR", "ORIB", "ORIW", "NOT", "SHIL", "SHILI", "SHIR", "SHIRI", "ADD", "ADDIB", "ADDIW", "INCR", "DECR", "MUL", "MULIB", "MULIW", "DIV", "DIVIB", "DIVIW", "MOD", "MODIB", "MODIW", "CLEAR", "MOV1B", "MOV2B", "MOV3B", "MOV4B", "MOV1W", "MOV2W", "MOV3W", "MOV4W", "MOVR", "SWAP", "PUSH", "PUSHIB", "PUSHIW", "PUSHIT", "POP", "PEEK", "CMP", "JMP", "CALL", "RET", "WRT", "READ"}
+var mnemonics []string = []string{"HLT", "AND", "ANDIB", "ANDIW", "OR", "ORIB", "ORIW", "NOT", "SHIL", "SHILI", "SHIR", "SHIRI", "ADD", "ADDIB", "ADDIW", "INCR", "DECR", "MUL", "MULIB", "MULIW", "DIV", "DIVIB", "DIVIW", "MOD", "MODIB", "MODIW", "CLEAR", "MOV1B", "MOV2B", "MOV3B", "MOV4B", "MOV1W", "MOV2W", "MOV3W", "MOV4W", "MOVR", "SWAP", "PUSH", "PUSHIB", "PUSHIW", "PUSHIT", "POP", "PEEK", "CMP", "JMP", "CALL", "RET", "WRT", "READ", "SEXT8", "SEXT16", "SEXT32", "ZEXT8", "ZEXT16", "ZEXT32", "SUB", "SUBIB", "SUBIW", "NEG", "XOR", "XORIB", "XORIW", "ROL", "ROLI", "ROR", "RORI", "SAR", "SARI", "MOVL", "JMPR", "CALLR", "READO", "WRTO", "READX", "WRTX"}
 var registersName []string = []string{"R0", "R1", "R2", "R3", "R4", "R5", "R6", "R7", "R8", "R9", "R10", "R11", "R12", "R13", "R14", "R15"}
 
-var compileTimeBug []string
+// Assembler turns .vasm source into bytecode. It never stops the process,
+// every problem it finds is added to Diagnostics. Defines holds constants
+// defined before the source, as with -D NAME=value.
+type Assembler struct {
+	Strict       bool
+	IncludePaths []string
+	Defines      map[string]string
+	Diagnostics  []Diagnostic
+	Symbols      SymbolTable
+	file         string
+	files        []string
+	sources      map[string][]string
+	includeStack []string
+
+	constants      map[string]Token
+	constantValues map[string]int64
+	constantStates map[string]int
+	macros         map[string]macro
+	expansions     int
+}
+
+func NewAssembler(strict bool) *Assembler {
+	return &Assembler{Strict: strict}
+}
+
+// Assemble assembles the source of file into the sections of a .vbc file.
+// When the source has errors it returns an error, the details are in
+// a.Diagnostics.
+func (a *Assembler) Assemble(file string, source string) (bytecodeFile, error) {
+	var assemblerProgram [][]Token = a.read(file, source)
+	var program bytecodeFile = newBytecodeFile([]section{{Kind: sectionCode}})
+	var err error
+	if len(assemblerProgram) != 0 {
+		program, err = a.programCleaner(assemblerProgram)
+	} else if a.hasErrors() {
+		err = errors.New("couldn't assemble " + a.file)
+	}
+	a.sortDiagnostics()
+	return program, err
+}
+
+// Expand gives the source of file once its macros, .rept and .irp are
+// expanded, with one instruction or directive per line.
+func (a *Assembler) Expand(file string, source string) (string, error) {
+	var text strings.Builder
+	for _, line := range a.read(file, source) {
+		text.WriteString(formatLine(line) + "\n")
+	}
+	var err error
+	if a.hasErrors() {
+		err = errors.New("couldn't expand " + a.file)
+	}
+	a.sortDiagnostics()
+	return text.String(), err
+}
+
+// sortDiagnostics sorts the diagnostics by position, the files being in the
+// order they were read.
+func (a *Assembler) sortDiagnostics() {
+	var fileIndex map[string]int = make(map[string]int)
+	for i, file := range a.files {
+		fileIndex[file] = i
+	}
+	sort.SliceStable(a.Diagnostics, func(i, j int) bool {
+		if a.Diagnostics[i].File != a.Diagnostics[j].File {
+			return fileIndex[a.Diagnostics[i].File] < fileIndex[a.Diagnostics[j].File]
+		}
+		if a.Diagnostics[i].Line != a.Diagnostics[j].Line {
+			return a.Diagnostics[i].Line < a.Diagnostics[j].Line
+		}
+		return a.Diagnostics[i].Column < a.Diagnostics[j].Column
+	})
+}
+
+// read tokenizes source and expands its macros, includes and
+// pseudo-instructions.
+func (a *Assembler) read(file string, source string) [][]Token {
+	a.file = file
+	a.files = nil
+	a.sources = make(map[string][]string)
+	a.includeStack = []string{absolutePath(file)}
+	a.Symbols = newSymbolTable()
+	a.constants = make(map[string]Token)
+	a.constantValues = make(map[string]int64)
+	a.constantStates = make(map[string]int)
+	a.macros = make(map[string]macro)
+	a.expansions = 0
+	for name, value := range a.Defines {
+		a.constants[name] = Token{Text: value, File: "<command line>"}
+	}
+	return a.expandPseudoInstructions(a.preprocess(a.tokenizeFile(file, source), 0))
+}
+
+// tokenizeFile tokenizes source and keeps its lines for the excerpts of the
+// diagnostics.
+func (a *Assembler) tokenizeFile(file string, source string) [][]Token {
+	if _, ok := a.sources[file]; !ok {
+		a.files = append(a.files, file)
+	}
+	a.sources[file] = strings.Split(source, "\n")
+	return a.tokenize(file, source)
+}
 
 var opcodeToMnemonics = map[int]string{
 	HLT: "HLT", AND: "AND", ANDIB: "ANDIB", ANDIW: "ANDIW", OR: "OR", ORIB: "ORIB", ORIW: "ORIW", NOT: "NOT", SHIL: "SHIL", SHILI: "SHILI", SHIR: "SHIR",
@@ -17,6 +118,10 @@ var opcodeToMnemonics = map[int]string{
 	MOD: "MOD", MODIB: "MODIB", MODIW: "MODIW", CLEAR: "CLEAR", MOV1B: "MOV1B", MOV2B: "MOV2B", MOV3B: "MOV3B", MOV4B: "MOV4B", MOV1W: "MOV1W", MOV2W: "MOV2W",
 	MOV3W: "MOV3W", MOV4W: "MOV4W", MOVR: "MOVR", SWAP: "SWAP", PUSH: "PUSH", PUSHIB: "PUSHIB", PUSHIW: "PUSHIW", PUSHIT: "PUSHIT", POP: "POP", PEEK: "PEEK", CMP: "CMP",
 	JMP: "JMP", JMPB: "JMPB", JMPW: "JMPW", JMPT: "JMPT", CALL: "CALL", CALLB: "CALLB", CALLW: "CALLW", CALLT: "CALLT", RET: "RET", WRT: "WRT", READ: "READ",
+	SEXT8: "SEXT8", SEXT16: "SEXT16", SEXT32: "SEXT32", ZEXT8: "ZEXT8", ZEXT16: "ZEXT16", ZEXT32: "ZEXT32",
+	SUB: "SUB", SUBIB: "SUBIB", SUBIW: "SUBIW", NEG: "NEG", XOR: "XOR", XORIB: "XORIB", XORIW: "XORIW",
+	ROL: "ROL", ROLI: "ROLI", ROR: "ROR", RORI: "RORI", SAR: "SAR", SARI: "SARI", MOVL: "MOVL", JMPR: "JMPR", CALLR: "CALLR",
+	READO: "READO", WRTO: "WRTO", READX: "READX", WRTX: "WRTX",
 }
 
 var mnemonicToOpcode = map[string]int{
@@ -25,6 +130,10 @@ var mnemonicToOpcode = map[string]int{
 	"MOD": MOD, "MODIB": MODIB, "MODIW": MODIW, "CLEAR": CLEAR, "MOV1B": MOV1B, "MOV2B": MOV2B, "MOV3B": MOV3B, "MOV4B": MOV4B,
 	"MOV1W": MOV1W, "MOV2W": MOV2W, "MOV3W": MOV3W, "MOV4W": MOV4W, "MOVR": MOVR, "SWAP": SWAP, "PUSH": PUSH, "PUSHIB": PUSHIB, "PUSHIW": PUSHIW, "PUSHIT": PUSHIT,
 	"POP": POP, "PEEK": PEEK, "CMP": CMP, "JMP": JMP, "JMPB": JMPB, "JMPW": JMPW, "JMPT": JMPT, "CALL": CALL, "CALLB": CALLB, "CALLW": CALLW, "CALLT": CALLT, "RET": RET, "WRT": WRT, "READ": READ,
+	"SEXT8": SEXT8, "SEXT16": SEXT16, "SEXT32": SEXT32, "ZEXT8": ZEXT8, "ZEXT16": ZEXT16, "ZEXT32": ZEXT32,
+	"SUB": SUB, "SUBIB": SUBIB, "SUBIW": SUBIW, "NEG": NEG, "XOR": XOR, "XORIB": XORIB, "XORIW": XORIW,
+	"ROL": ROL, "ROLI": ROLI, "ROR": ROR, "RORI": RORI, "SAR": SAR, "SARI": SARI, "MOVL": MOVL, "JMPR": JMPR, "CALLR": CALLR,
+	"READO": READO, "WRTO": WRTO, "READX": READX, "WRTX": WRTX,
 }
 
 var comparOpToOpcode = map[string]string{
@@ -87,6 +196,32 @@ var syntaxRules = map[string][]string{
 	"RET":    {},
 	"WRT":    {"Size", "Address", "Register"},
 	"READ":   {"Register", "Size", "Address"},
+	"SEXT8":  {"Register"},
+	"SEXT16": {"Register"},
+	"SEXT32": {"Register"},
+	"ZEXT8":  {"Register"},
+	"ZEXT16": {"Register"},
+	"ZEXT32": {"Register"},
+	"SUB":    {"Register", "Register"},
+	"SUBIB":  {"Register", "Int8"},
+	"SUBIW":  {"Register", "Int16"},
+	"NEG":    {"Register"},
+	"XOR":    {"Register", "Register"},
+	"XORIB":  {"Register", "Int8"},
+	"XORIW":  {"Register", "Int16"},
+	"ROL":    {"Register", "Register"},
+	"ROLI":   {"Register", "Int8"},
+	"ROR":    {"Register", "Register"},
+	"RORI":   {"Register", "Int8"},
+	"SAR":    {"Register", "Register"},
+	"SARI":   {"Register", "Int8"},
+	"MOVL":   {"Register", "Offset"},
+	"JMPR":   {"Register"},
+	"CALLR":  {"Register"},
+	"READO":  {"Register", "Size", "Address", "Displacement"},
+	"WRTO":   {"Size", "Address", "Register", "Displacement"},
+	"READX":  {"Register", "Size", "Address", "Register", "Scale"},
+	"WRTX":   {"Size", "Address", "Register", "Register", "Scale"},
 }
 
 var forbiddenLabels []string = []string{"R0", "R1", "R2", "R3", "R4", "R5", "R6", "R7", "R8", "R9", "R10", "R11", "R12", "R13", "R14", "R15",
@@ -94,204 +229,353 @@ var forbiddenLabels []string = []string{"R0", "R1", "R2", "R3", "R4", "R5", "R6"
 	"HLT", "AND", "ANDIB", "ANDIW", "OR", "ORIB", "ORIW", "NOT", "SHIL", "SHILI", "SHIR", "SHIRI", "ADD", "ADDIB", "ADDIW", "INCR", "DECR",
 	"MUL", "MULIB", "MULIW", "DIV", "DIVIB", "DIVIW", "MOD", "MODIB", "MODIW", "CLEAR", "MOV1B", "MOV2B", "MOV3B", "MOV4B", "MOV1W", "MOV2W", "MOV3W", "MOV4W",
 	"MOVR", "SWAP", "PUSH", "PUSHIB", "PUSHIW", "PUSHIT", "POP", "PEEK", "CMP", "JMP", "JMPB", "JMPW", "JMPT", "CALL", "CALLB", "CALLW", "CALLT", "RET", "WRT", "READ",
+	"SEXT8", "SEXT16", "SEXT32", "ZEXT8", "ZEXT16", "ZEXT32", "SUB", "SUBIB", "SUBIW", "NEG", "XOR", "XORIB", "XORIW",
+	"ROL", "ROLI", "ROR", "RORI", "SAR", "SARI", "MOVL", "JMPR", "CALLR", "READO", "WRTO", "READX", "WRTX",
+	".equ", ".include", ".incbin", ".macro", ".endm", ".rept", ".irp", ".endr", ".text", ".data", ".bss", ".byte", ".word", ".dword", ".qword", ".ascii", ".asciz", ".zero", ".align", ".addr",
+	".if", ".ifdef", ".ifndef", ".elif", ".else", ".endif", ".error", ".warning",
+	"LI", "SWITCH",
 	"E", "G", "L", "NE"}
 
 ///////////////////////
 // Clean the program //
 ///////////////////////
 
-func programCleaner(assemblerProgram [][]string) []uint8 {
-	var assemblerProgramWithBlankLine [][]string = assemblerProgram
-	var numberOfBlankLines int
-	assemblerProgram = cleanEmpty(assemblerProgram)
+func (a *Assembler) programCleaner(assemblerProgram [][]Token) (bytecodeFile, error) {
+	var tokenizedProgram [][]Token
+	var lineSections []string
+	var offsets []int
+	var wellFormed []bool
+	assemblerProgram = a.scopeLabels(assemblerProgram)
 
-	var labels = make(map[string]int)
-	var tokenizedProgram [][][]string
+	// Every section is filled from its offset 0, the addresses are only known
+	// once the size of every section is. A label gets the offset of the next
+	// line, instructions are aligned on 4 bytes, data is not.
+	type labelDefinition struct {
+		token   Token
+		section string
+		offset  int
+	}
+	var labelDefinitions []labelDefinition
+	var pendingLabels []Token
+	var section string = ".text"
+	var sizes map[string]int = make(map[string]int)
+	var alignments map[string]int = make(map[string]int)
+	for _, line := range assemblerProgram {
+		if line[0].Text == ".equ" {
+			// already defined by preprocess
+			continue
+		}
+		var word string = line[0].Text
+		if word[len(word)-1] == ':' {
+			pendingLabels = append(pendingLabels, line[0])
+			if len(line) == 1 {
+				continue
+			}
+			line = line[1:]
+		}
+		if inList(sectionNames, line[0].Text) {
+			if len(line) != 1 {
+				a.errorAt(line[1], codeWrongNumberOfArgs, "\""+line[0].Text+"\" takes no argument")
+			}
+			section = line[0].Text
+			continue
+		}
 
-	var memoryAddress int
-	for i, line := range assemblerProgram {
-		for isEmpty(assemblerProgramWithBlankLine[i+numberOfBlankLines]) {
-			numberOfBlankLines += 1
+		a.checkSection(line, section)
+		var size int
+		var ok bool = true
+		if inList(dataDirectives, line[0].Text) {
+			var alignment int
+			size, alignment = a.directiveSize(line, sizes[section])
+			alignments[section] = max(alignments[section], alignment)
+		} else {
+			ok = a.checkOperation(line[0])
+			if ok {
+				ok = a.checkNumberOfArgs(line)
+				line = a.splitAddress(line)
+				line = a.checkWords(line)
+				a.checkSyntax(line, syntaxRules[line[0].Text])
+			}
+			sizes[section] = alignTo(sizes[section], 4)
+			size = 4
 		}
-		line = checkUnexpectedCharacter(line)
-		checkNumberOfArgs(line, i+numberOfBlankLines)
-		tokenizedProgram = append(tokenizedProgram, checkWords(line, i+numberOfBlankLines))
-		memoryAddress, labels = checkJumps(tokenizedProgram[i], labels, memoryAddress)
-		checkSyntax(tokenizedProgram[i], syntaxRules[tokenizedProgram[i][0][0]])
-		memoryAddress += 4
+		for _, label := range pendingLabels {
+			labelDefinitions = append(labelDefinitions, labelDefinition{label, section, sizes[section]})
+		}
+		pendingLabels = nil
+		tokenizedProgram = append(tokenizedProgram, line)
+		lineSections = append(lineSections, section)
+		offsets = append(offsets, sizes[section])
+		wellFormed = append(wellFormed, ok)
+		sizes[section] += size
+	}
+	for _, label := range pendingLabels {
+		labelDefinitions = append(labelDefinitions, labelDefinition{label, section, sizes[section]})
 	}
-	tokenizedProgram = delLabels(tokenizedProgram)
 
-	memoryAddress = 0
+	var layout sectionLayout = newSectionLayout(sizes, alignments)
+	for _, definition := range labelDefinitions {
+		a.checkJumps(definition.token, definition.section, layout.Bases[definition.section]+definition.offset)
+	}
+
+	// Every label is known from here, so the expressions can be evaluated.
+	var data map[int][]uint8 = make(map[int][]uint8)
 	for i, line := range tokenizedProgram {
-		if line[0][0] == "JMP" || line[0][0] == "CALL" {
-			tokenizedProgram[i] = createJumpAddress(labels, line, memoryAddress)
+		var address int = layout.Bases[lineSections[i]] + offsets[i]
+		if inList(dataDirectives, line[0].Text) {
+			data[i] = a.directiveBytes(line)
+		} else if line[0].Text == "JMP" || line[0].Text == "CALL" || line[0].Text == "MOVL" {
+			// without its operand the target would be the mnemonic itself
+			if wellFormed[i] {
+				tokenizedProgram[i] = a.createJumpAddress(line, address)
+			}
+		} else {
+			tokenizedProgram[i] = a.evaluateImmediates(line)
 		}
-		memoryAddress += 4
+	}
+	a.reportUnusedSymbols()
+
+	if a.hasErrors() {
+		return bytecodeFile{}, errors.New("couldn't assemble " + a.file)
 	}
 	tokenizedProgram = optimizeJumps(tokenizedProgram)
 
-	if len(compileTimeBug) != 0 {
-		for _, err := range compileTimeBug {
-			fmt.Println(err)
+	var contents map[string][]uint8 = make(map[string][]uint8)
+	for i, line := range tokenizedProgram {
+		var content []uint8 = contents[lineSections[i]]
+		for len(content) < offsets[i] {
+			content = append(content, 0)
 		}
-		log.Fatal("Couldn't compile")
-	} else {
-		fmt.Println("No compile error")
+		if inList(dataDirectives, line[0].Text) {
+			content = append(content, data[i]...)
+		} else {
+			content = append(content, bytificationOfTheProgram([][]uint32{mnemonicsToOpcode(line)})...)
+		}
+		contents[lineSections[i]] = content
 	}
-
-	var opcodeProgram [][]uint32
-	for _, line := range tokenizedProgram {
-		opcodeProgram = append(opcodeProgram, mnemonicsToOpcode(line))
+	for _, name := range sectionNames {
+		for len(contents[name]) < sizes[name] {
+			contents[name] = append(contents[name], 0)
+		}
 	}
 
-	var byteProgram []uint8 = bytificationOfTheProgram(opcodeProgram)
-
-	return byteProgram
+	return layout.bytecodeFile(contents), nil
 }
 
 //////////////////
 // CLEAN HELPER //
 //////////////////
 
-func isEmpty(line []string) bool {
-	for _, word := range line {
-		if len(word) != 0 {
-			return false
-		}
+// checkOperation reports the first word of a line that is neither a label, a
+// directive nor an operation, such as a lone number.
+func (a *Assembler) checkOperation(token Token) bool {
+	if !inList(mnemonics, token.Text) {
+		a.errorAt(token, codeUnrecognizedToken, "unknown operation \""+token.Text+"\"")
+		return false
 	}
 	return true
 }
 
-func cleanEmpty(assemblerProgram [][]string) [][]string {
-	var cleanedProgram [][]string
-	for _, line := range assemblerProgram {
-		var cleanedLine []string
-		for _, word := range line {
-			if len(word) != 0 {
-				cleanedLine = append(cleanedLine, word)
-			}
-		}
-		if len(cleanedLine) != 0 {
-			cleanedProgram = append(cleanedProgram, cleanedLine)
-		}
-	}
-	return cleanedProgram
-}
-
-func checkUnexpectedCharacter(line []string) []string {
-	validChars := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890:-*@"
-	for i := range len(line) {
-		var cleanedString string = ""
-		for _, character := range line[i] {
-			if strings.Contains(validChars, string(character)) {
-				cleanedString += string(character)
-			}
-		}
-		line[i] = cleanedString
-	}
-	return line
-}
-
-func checkNumberOfArgs(line []string, i int) {
-	if len(syntaxRules[line[0]]) != len(line)-1 {
-		compileTimeBug = append(compileTimeBug, "Wrong number of args for \""+line[0]+"\" at line "+intToStr(i+1))
+func (a *Assembler) checkNumberOfArgs(line []Token) bool {
+	if len(syntaxRules[line[0].Text]) != len(line)-1 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \""+line[0].Text+"\", expected "+intToStr(len(syntaxRules[line[0].Text]))+" but got "+intToStr(len(line)-1))
+		return false
 	}
+	return true
 }
 
-func checkWords(line []string, i int) [][]string {
-	var newLine [][]string
-	for j, word := range line {
+func (a *Assembler) checkWords(line []Token) []Token {
+	var newLine []Token
+	var operation string = line[0].Text
+	for j, token := range line {
+		var word string = token.Text
 		if inList(mnemonics, word) {
-			newLine = append(newLine, []string{word, "Operation"})
+			token.Kind = "Operation"
 		} else if inList([]string{"G", "L", "E", "NE"}, word) {
-			newLine = append(newLine, []string{comparOpToOpcode[word], "Comparison"})
-		} else if word[len(word)-1] == ':' || (j > 0 && (line[j-1] == "JMP" || line[j-1] == "CALL")) {
-			newLine = append(newLine, []string{word, "Offset"})
+			token.Text, token.Kind = comparOpToOpcode[word], "Comparison"
+		} else if word[len(word)-1] == ':' || (j > 0 && j-1 < len(syntaxRules[operation]) && syntaxRules[operation][j-1] == "Offset") {
+			token.Kind = "Offset"
 		} else if inList(registersName, word) {
-			newLine = append(newLine, []string{word[1:], "Register"})
-		} else if word[0] == '@' && isInt(word[1:]) && isPowerOfTwo(strToInt(word[1:])) && strToInt(word[1:]) >= 8 && strToInt(word[1:]) <= 64 {
-			newLine = append(newLine, []string{intToStr(strToInt(word[1:]) / 8), "Size"})
+			token.Text, token.Kind = word[1:], "Register"
+		} else if word[0] == '@' && len(word) > 1 && isInt(word[1:]) && isPowerOfTwo(strToInt(word[1:])) && strToInt(word[1:]) >= 8 && strToInt(word[1:]) <= 64 {
+			token.Text, token.Kind = intToStr(strToInt(word[1:])/8), "Size"
 		} else if word[0] == '*' && inList(registersName, word[1:]) {
-			newLine = append(newLine, []string{word[2:], "Address"})
-		} else if isInt(word) {
-			var number uint64 = uint64(strToInt(word))
-			if inList([]string{"ANDIB", "ORIB", "SHILI", "SHIRI", "ADDIB", "MULIB", "DIVIB", "MODIB", "MOV1B", "MOV2B", "MOV3B", "MOV4B", "PUSHIB"}, line[0]) && number < 256 {
-				newLine = append(newLine, []string{word, "Int8"})
-			} else if inList([]string{"ANDIW", "ORIW", "ADDIW", "MULIW", "DIVIW", "MODIW", "MOV1W", "MOV2W", "MOV3W", "MOV4W", "PUSHIW"}, line[0]) && number < 65536 {
-				newLine = append(newLine, []string{word, "Int16"})
-			} else if line[0] == "PUSHIT" && number < 16777216 {
-				newLine = append(newLine, []string{word, "Int24"})
-			} else if inList([]string{"ANDIB", "ORIB", "SHILI", "SHIRI", "ADDIB", "MULIB", "DIVIB", "MODIB", "MOV1B", "MOV2B", "MOV3B", "MOV4B", "PUSHIB", "ANDIW", "ORIW", "ADDIW", "MULIW", "DIVIW", "MODIW", "MOV1W", "MOV2W", "MOV3W", "MOV4W", "PUSHIW", "PUSHIT"}, line[0]) {
-				compileTimeBug = append(compileTimeBug, "Immediate \""+word+"\" is too big at line "+intToStr(i+1))
+			token.Text, token.Kind = word[2:], "Address"
+		} else if j > 0 && j-1 < len(syntaxRules[operation]) && syntaxRules[operation][j-1] == "Scale" {
+			if !inList([]string{"1", "2", "4", "8"}, word) {
+				a.errorAt(token, codeSyntaxError, "the scale of an index must be 1, 2, 4 or 8, got \""+word+"\"")
 			}
+			token.Text, token.Kind = intToStr(map[string]int{"1": 0, "2": 1, "4": 2, "8": 3}[word]), "Scale"
+		} else if j > 0 && j-1 < len(syntaxRules[operation]) && inList([]string{"Int8", "Int16", "Int24", "Displacement"}, syntaxRules[operation][j-1]) {
+			// evaluated by evaluateImmediates once the labels are known
+			token.Kind = syntaxRules[operation][j-1]
+		} else if isNumberLiteral(word) {
+			token.Kind = "Int"
 		} else {
-			compileTimeBug = append(compileTimeBug, "Unrecognized token \""+word+"\" at line "+intToStr(i+1))
+			a.errorAt(token, codeUnrecognizedToken, "unrecognized token \""+word+"\"")
 		}
+		newLine = append(newLine, token)
 	}
-	newLine = append(newLine, []string{intToStr(i), "Line"})
 	return newLine
 }
 
-func checkJumps(line [][]string, labels map[string]int, memoryAddress int) (int, map[string]int) {
-	if line[0][0][len(line[0][0])-1] == ':' {
-		if !(inList(forbiddenLabels, line[0][0][:len(line[0][0])-1])) {
-			labels[string(line[0][0][:len(line[0][0])-1])] = memoryAddress - 1
-			memoryAddress -= 4
-		} else {
-			compileTimeBug = append(compileTimeBug, "Forbiddent label name \""+string(line[0][0][:len(line[0][0])-1])+"\" at line "+intToStr(strToInt(string(line[1][0]))+1))
-		}
+// checkJumps adds label to the symbol table at its exact byte address.
+func (a *Assembler) checkJumps(label Token, section string, memoryAddress int) {
+	var name string = labelName(label)
+	if name == "" {
+		// already reported by scopeLabels
+		return
+	} else if inList(forbiddenLabels, name) || !isIdentifier(name) {
+		a.errorAt(label, codeForbiddenLabel, "forbidden label name \""+name+"\"")
+	} else if _, ok := a.constants[name]; ok {
+		a.errorAt(label, codeDuplicateSymbol, "\""+name+"\" is already defined as a constant")
+	} else if first, ok := a.Symbols.define(Symbol{Name: name, Address: memoryAddress, Section: section, Scope: label.Kind, Definition: label}); !ok {
+		a.errorAt(label, codeDuplicateSymbol, "label \""+name+"\" is already defined")
+		a.noteAt(first.Definition, "first defined here")
 	}
-	return memoryAddress, labels
 }
 
-func checkSyntax(line [][]string, rules []string) {
-	var errorSyntax bool = false
-	for j := 0; j < len(rules) && j < len(line); j++ {
-		if rules[j] != line[j+1][1] {
-			errorSyntax = true
+// splitAddress rewrites the READ and WRT whose address has an offset or an
+// index, the offset or the index and its scale becoming operands of their own :
+// `READ R1 @8 *R2+16` becomes `READO R1 @8 *R2 +16`, and `WRT @64 *R2+R3*8 R1`
+// becomes `WRTX @64 *R2 R1 R3 8`.
+func (a *Assembler) splitAddress(line []Token) []Token {
+	var j int = 3
+	if line[0].Text == "WRT" {
+		j = 2
+	} else if line[0].Text != "READ" {
+		return line
+	}
+	if len(line) != 4 || !strings.HasPrefix(line[j].Text, "*") {
+		return line
+	}
+	var word string = strings.ReplaceAll(line[j].Text, " ", "")
+	var base string = registerPrefix(word[1:])
+	var rest string = word[1+len(base):]
+	if base == "" || rest == "" || (rest[0] != '+' && rest[0] != '-') {
+		return line
+	}
+
+	var address Token = line[j]
+	address.Text = "*" + base
+	var operand Token = line[j]
+	operand.Column += 1 + len(base)
+	var extra []Token
+	var index string = registerPrefix(rest[1:])
+	var scale string = strings.TrimPrefix(rest[1+len(index):], "*")
+	if index != "" && (len(rest) == 1+len(index) || rest[1+len(index)] == '*') {
+		if rest[0] == '-' {
+			a.errorAt(operand, codeSyntaxError, "an index can only be added to the base register, as in *R1+R2*8")
 		}
+		if scale == "" {
+			scale = "1"
+		}
+		var indexToken, scaleToken Token = operand, operand
+		indexToken.Text, scaleToken.Text = index, scale
+		extra = []Token{indexToken, scaleToken}
+		line[0].Text += "X"
+	} else {
+		operand.Text = rest
+		extra = []Token{operand}
+		line[0].Text += "O"
 	}
-	if errorSyntax {
-		compileTimeBug = append(compileTimeBug, "Syntax error at line "+intToStr(strToInt(line[len(line)-1][0])+1))
+	var newLine []Token = append([]Token{}, line[:j]...)
+	newLine = append(newLine, address)
+	newLine = append(newLine, line[j+1:]...)
+	return append(newLine, extra...)
+}
+
+// sourceMnemonic gives the operation the way it is written in the source, READ
+// or WRT for the operations splitAddress creates.
+func sourceMnemonic(operation string) string {
+	if inList([]string{"READO", "READX", "WRTO", "WRTX"}, operation) {
+		return operation[:len(operation)-1]
 	}
+	return operation
 }
 
-func delLabels(tokenizedProgram [][][]string) [][][]string {
-	var cleanedProgram [][][]string
-	for _, line := range tokenizedProgram {
-		if line[0][1] != "Offset" {
-			cleanedProgram = append(cleanedProgram, line)
+// registerPrefix gives the longest register name text starts with, or "".
+func registerPrefix(text string) string {
+	var register string = ""
+	for _, name := range registersName {
+		if strings.HasPrefix(text, name) && len(name) > len(register) {
+			register = name
+		}
+	}
+	return register
+}
+
+func (a *Assembler) checkSyntax(line []Token, rules []string) {
+	for j := 0; j < len(rules) && j+1 < len(line); j++ {
+		if rules[j] != line[j+1].Kind {
+			a.errorAt(line[j+1], codeSyntaxError, "syntax error, expected "+rules[j]+" for \""+sourceMnemonic(line[0].Text)+"\"")
+			return
 		}
 	}
-	return cleanedProgram
 }
 
-func createJumpAddress(labels map[string]int, line [][]string, memoryAdress int) [][]string {
-	var targetLine int = labels[line[1][0]]
-	if targetLine == 0 {
-		compileTimeBug = append(compileTimeBug, "Undefined label \""+line[1][0]+"\" at line "+intToStr(strToInt(line[len(line)-1][0])+1))
+// createJumpAddress replaces the label of a JMP, a CALL or a MOVL by its offset
+// from the address of the instruction. The offset of MOVL is on 16 bits.
+func (a *Assembler) createJumpAddress(line []Token, memoryAdress int) []Token {
+	var j int = len(line) - 1
+	target, ok := a.evaluate(line[j])
+	var offset int64 = target - int64(memoryAdress)
+	if ok && line[0].Text == "MOVL" && (offset < -32768 || offset > 32767) {
+		a.errorAt(line[j], codeImmediateTooBig, "\""+line[j].Text+"\" is "+formatValue(offset)+" bytes away from the MOVL, it must be between -32768 and 32767")
+		ok = false
+	} else if ok && line[0].Text != "MOVL" && (offset < -8388608 || offset > 8388607) {
+		// the offset of JMPT and CALLT is 24 bits
+		a.errorAt(line[j], codeImmediateTooBig, "\""+line[j].Text+"\" is "+formatValue(offset)+" bytes away from the "+line[0].Text+", it must be between -8388608 and 8388607")
+		ok = false
 	}
-	var offset int = targetLine - memoryAdress
-	if offset > 0 {
-		offset -= 1
+	if ok {
+		line[j].Text = formatValue(offset)
+	} else {
+		line[j].Text = "0"
 	}
-	line[1][0] = intToStr(offset)
 	return line
 }
 
-func optimizeJumps(tokenizedProgram [][][]string) [][][]string {
-	var optimizedProgram [][][]string
+// evaluateImmediates replaces the expression of every immediate of line by its
+// value, and checks that the value fits in the operand.
+func (a *Assembler) evaluateImmediates(line []Token) []Token {
+	var operation string = line[0].Text
+	for j := 1; j < len(line); j++ {
+		var kind string = line[j].Kind
+		if !inList([]string{"Int8", "Int16", "Int24", "Displacement"}, kind) {
+			continue
+		}
+		value, ok := a.evaluate(line[j])
+		if !ok {
+			line[j].Text = "0"
+			continue
+		}
+		if low, high := immediateRange(operation, kind); value < low || value > high {
+			var shown string = "\"" + line[j].Text + "\""
+			if line[j].Text != formatValue(value) {
+				shown += " (" + formatValue(value) + ")"
+			}
+			a.errorAt(line[j], codeImmediateTooBig, "immediate "+shown+" does not fit in the "+kind+" of \""+sourceMnemonic(operation)+"\", it must be between "+formatValue(low)+" and "+formatValue(high))
+		} else if value == 0 && inList([]string{"DIVIB", "DIVIW", "MODIB", "MODIW"}, operation) {
+			a.errorAt(line[j], codeDivisionByZero, "division by zero")
+		}
+		line[j].Text = formatValue(value)
+	}
+	return line
+}
+
+func optimizeJumps(tokenizedProgram [][]Token) [][]Token {
+	var optimizedProgram [][]Token
 	for _, line := range tokenizedProgram {
-		if line[0][0] == "JMP" || line[0][0] == "CALL" {
-			if strToInt(line[1][0]) <= 127 && strToInt(line[1][0]) >= -128 {
-				line[0][0] = line[0][0] + "B"
+		if line[0].Text == "JMP" || line[0].Text == "CALL" {
+			if strToInt(line[1].Text) <= 127 && strToInt(line[1].Text) >= -128 {
+				line[0].Text = line[0].Text + "B"
 				optimizedProgram = append(optimizedProgram, line)
-			} else if strToInt(line[1][0]) <= 32767 && strToInt(line[1][0]) >= -32768 {
-				line[0][0] = line[0][0] + "W"
+			} else if strToInt(line[1].Text) <= 32767 && strToInt(line[1].Text) >= -32768 {
+				line[0].Text = line[0].Text + "W"
 				optimizedProgram = append(optimizedProgram, line)
 			} else {
-				line[0][0] = line[0][0] + "T"
+				line[0].Text = line[0].Text + "T"
 				optimizedProgram = append(optimizedProgram, line)
 			}
 		} else {
@@ -301,22 +585,27 @@ func optimizeJumps(tokenizedProgram [][][]string) [][][]string {
 	return optimizedProgram
 }
 
-func mnemonicsToOpcode(line [][]string) []uint32 {
+func mnemonicsToOpcode(line []Token) []uint32 {
 	var newLine []uint32
-	if string(line[0][0]) == "HLT" || string(line[0][0]) == "RET" {
-		newLine = []uint32{uint32(mnemonicToOpcode[line[0][0]])}
-	} else if inList([]string{"NOT", "INCR", "DECR", "CLEAR", "PUSH", "PUSHIB", "PUSHIW", "PUSHIT", "POP", "PEEK", "JMPB", "JMPW", "JMPT", "CALLB", "CALLW", "CALLT"}, string(line[0][0])) {
-		var arg1 uint32 = uint32(strToInt(line[1][0]))
-		newLine = []uint32{uint32(mnemonicToOpcode[line[0][0]]), arg1}
-	} else if inList([]string{"AND", "ANDIB", "ANDIW", "OR", "ORIB", "ORIW", "SHIL", "SHILI", "SHIR", "SHIRI", "ADD", "ADDIB", "ADDIW", "MUL", "MULIB", "MULIW", "DIV", "DIVIB", "DIVIW", "MOD", "MODIB", "MODIW", "MOV1B", "MOV2B", "MOV3B", "MOV4B", "MOV1W", "MOV2W", "MOV3W", "MOV4W", "MOVR", "SWAP"}, string(line[0][0])) {
-		var arg1 uint32 = uint32(strToInt(line[1][0]))
-		var arg2 uint32 = uint32(strToInt(line[2][0]))
-		newLine = []uint32{uint32(mnemonicToOpcode[line[0][0]]), arg1, arg2}
-	} else if inList([]string{"CMP", "WRT", "READ"}, string(line[0][0])) {
-		var arg1 uint32 = uint32(strToInt(line[1][0]))
-		var arg2 uint32 = uint32(strToInt(line[2][0]))
-		var arg3 uint32 = uint32(strToInt(line[3][0]))
-		newLine = []uint32{uint32(mnemonicToOpcode[line[0][0]]), arg1, arg2, arg3}
+	if line[0].Text == "HLT" || line[0].Text == "RET" {
+		newLine = []uint32{uint32(mnemonicToOpcode[line[0].Text])}
+	} else if inList([]string{"NOT", "INCR", "DECR", "CLEAR", "PUSH", "PUSHIB", "PUSHIW", "PUSHIT", "POP", "PEEK", "JMPB", "JMPW", "JMPT", "CALLB", "CALLW", "CALLT", "SEXT8", "SEXT16", "SEXT32", "ZEXT8", "ZEXT16", "ZEXT32", "NEG", "JMPR", "CALLR"}, line[0].Text) {
+		var arg1 uint32 = uint32(strToInt(line[1].Text))
+		newLine = []uint32{uint32(mnemonicToOpcode[line[0].Text]), arg1}
+	} else if inList([]string{"AND", "ANDIB", "ANDIW", "OR", "ORIB", "ORIW", "SHIL", "SHILI", "SHIR", "SHIRI", "ADD", "ADDIB", "ADDIW", "MUL", "MULIB", "MULIW", "DIV", "DIVIB", "DIVIW", "MOD", "MODIB", "MODIW", "MOV1B", "MOV2B", "MOV3B", "MOV4B", "MOV1W", "MOV2W", "MOV3W", "MOV4W", "MOVR", "SWAP", "SUB", "SUBIB", "SUBIW", "XOR", "XORIB", "XORIW", "ROL", "ROLI", "ROR", "RORI", "SAR", "SARI", "MOVL"}, line[0].Text) {
+		var arg1 uint32 = uint32(strToInt(line[1].Text))
+		var arg2 uint32 = uint32(strToInt(line[2].Text))
+		newLine = []uint32{uint32(mnemonicToOpcode[line[0].Text]), arg1, arg2}
+	} else if inList([]string{"READO", "WRTO", "READX", "WRTX"}, line[0].Text) {
+		newLine = []uint32{uint32(mnemonicToOpcode[line[0].Text])}
+		for _, token := range line[1:] {
+			newLine = append(newLine, uint32(strToInt(token.Text)))
+		}
+	} else if inList([]string{"CMP", "WRT", "READ"}, line[0].Text) {
+		var arg1 uint32 = uint32(strToInt(line[1].Text))
+		var arg2 uint32 = uint32(strToInt(line[2].Text))
+		var arg3 uint32 = uint32(strToInt(line[3].Text))
+		newLine = []uint32{uint32(mnemonicToOpcode[line[0].Text]), arg1, arg2, arg3}
 	}
 	return newLine
 }
@@ -330,12 +619,12 @@ func bytificationOfTheProgram(opcodeProgram [][]uint32) []uint8 {
 			byteProgram = append(byteProgram, 0)
 			byteProgram = append(byteProgram, 0)
 			byteProgram = append(byteProgram, 0)
-		case uint32(NOT), uint32(INCR), uint32(DECR), uint32(CLEAR), uint32(PUSH), uint32(PUSHIB), uint32(POP), uint32(PEEK), uint32(JMPB), uint32(CALLB):
+		case uint32(NOT), uint32(INCR), uint32(DECR), uint32(CLEAR), uint32(PUSH), uint32(PUSHIB), uint32(POP), uint32(PEEK), uint32(JMPB), uint32(CALLB), uint32(SEXT8), uint32(SEXT16), uint32(SEXT32), uint32(ZEXT8), uint32(ZEXT16), uint32(ZEXT32), uint32(NEG), uint32(JMPR), uint32(CALLR):
 			byteProgram = append(byteProgram, uint8(line[0]))
 			byteProgram = append(byteProgram, uint8(line[1]))
 			byteProgram = append(byteProgram, 0)
 			byteProgram = append(byteProgram, 0)
-		case uint32(AND), uint32(ANDIB), uint32(OR), uint32(ORIB), uint32(SHIL), uint32(SHILI), uint32(SHIR), uint32(SHIRI), uint32(ADD), uint32(ADDIB), uint32(MUL), uint32(MULIB), uint32(DIV), uint32(DIVIB), uint32(MOD), uint32(MODIB), uint32(MOV1B), uint32(MOV2B), uint32(MOV3B), uint32(MOV4B), uint32(MOVR), uint32(SWAP):
+		case uint32(AND), uint32(ANDIB), uint32(OR), uint32(ORIB), uint32(SHIL), uint32(SHILI), uint32(SHIR), uint32(SHIRI), uint32(ADD), uint32(ADDIB), uint32(MUL), uint32(MULIB), uint32(DIV), uint32(DIVIB), uint32(MOD), uint32(MODIB), uint32(MOV1B), uint32(MOV2B), uint32(MOV3B), uint32(MOV4B), uint32(MOVR), uint32(SWAP), uint32(SUB), uint32(SUBIB), uint32(XOR), uint32(XORIB), uint32(ROL), uint32(ROLI), uint32(ROR), uint32(RORI), uint32(SAR), uint32(SARI):
 			byteProgram = append(byteProgram, uint8(line[0]))
 			byteProgram = append(byteProgram, uint8(line[1]))
 			byteProgram = append(byteProgram, uint8(line[2]))
@@ -345,7 +634,7 @@ func bytificationOfTheProgram(opcodeProgram [][]uint32) []uint8 {
 			byteProgram = append(byteProgram, uint8(line[1]))
 			byteProgram = append(byteProgram, uint8(line[1]>>8))
 			byteProgram = append(byteProgram, 0)
-		case uint32(ANDIW), uint32(ORIW), uint32(ADDIW), uint32(MULIW), uint32(DIVIW), uint32(MODIW), uint32(MOV1W), uint32(MOV2W), uint32(MOV3W), uint32(MOV4W):
+		case uint32(ANDIW), uint32(ORIW), uint32(ADDIW), uint32(MULIW), uint32(DIVIW), uint32(MODIW), uint32(MOV1W), uint32(MOV2W), uint32(MOV3W), uint32(MOV4W), uint32(SUBIW), uint32(XORIW), uint32(MOVL):
 			byteProgram = append(byteProgram, uint8(line[0]))
 			byteProgram = append(byteProgram, uint8(line[1]))
 			byteProgram = append(byteProgram, uint8(line[2]))
@@ -355,6 +644,17 @@ func bytificationOfTheProgram(opcodeProgram [][]uint32) []uint8 {
 			byteProgram = append(byteProgram, uint8(line[1]))
 			byteProgram = append(byteProgram, uint8(line[1]>>8))
 			byteProgram = append(byteProgram, uint8(line[1]>>16))
+		// The data and base registers share the first byte. READO and WRTO
+		// then hold the size and a 12 bits displacement, READX and WRTX the
+		// index register, the log2 of its scale and the size.
+		case uint32(READO):
+			byteProgram = append(byteProgram, uint8(line[0]), uint8(line[1]|line[3]<<4), uint8(line[2]|(line[4]&0xF)<<4), uint8(line[4]>>4))
+		case uint32(WRTO):
+			byteProgram = append(byteProgram, uint8(line[0]), uint8(line[3]|line[2]<<4), uint8(line[1]|(line[4]&0xF)<<4), uint8(line[4]>>4))
+		case uint32(READX):
+			byteProgram = append(byteProgram, uint8(line[0]), uint8(line[1]|line[3]<<4), uint8(line[4]|line[5]<<4), uint8(line[2]))
+		case uint32(WRTX):
+			byteProgram = append(byteProgram, uint8(line[0]), uint8(line[3]|line[2]<<4), uint8(line[4]|line[5]<<4), uint8(line[1]))
 		case uint32(CMP), uint32(WRT), uint32(READ):
 			byteProgram = append(byteProgram, uint8(line[0]))
 			byteProgram = append(byteProgram, uint8(line[1]))
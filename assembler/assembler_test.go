@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInvalidSize(t *testing.T) {
+	for _, source := range []string{"READ R1 @ *R2\nHLT\n", "READ R1 @- *R2\nHLT\n", "WRT @ *R2 R1\nHLT\n", "READ R1 @12 *R2\nHLT\n"} {
+		expectError(t, source, codeSyntaxError)
+	}
+}
+
+// A line must start with an operation, a lone number once got through every
+// check and crashed the encoder.
+func TestUnknownOperation(t *testing.T) {
+	for _, source := range []string{"5\nHLT\n", "0000\n", "HLT\nR1\n", "E\n", "*R1 R2\n", "FOO R1\n"} {
+		expectError(t, source, codeUnrecognizedToken)
+	}
+}
+
+// A jump without its operand gives one error, not an undefined symbol too.
+func TestJumpWithoutOperand(t *testing.T) {
+	for _, source := range []string{"JMP\nHLT\n", "CALL\nHLT\n", "MOVL R1\nHLT\n"} {
+		var a *Assembler = NewAssembler(false)
+		a.Assemble("test.vasm", source)
+		if len(a.Diagnostics) != 1 || a.Diagnostics[0].Code != codeWrongNumberOfArgs {
+			t.Errorf("Assemble(%q) gave %v, want only a %s", source, a.Diagnostics, codeWrongNumberOfArgs)
+		}
+	}
+}
+
+// An offset that does not fit in JMPT or CALLT must not be truncated.
+func TestFarJump(t *testing.T) {
+	expectError(t, "JMP far\n.zero 9000000\nfar:\nHLT\n", codeImmediateTooBig)
+	expectError(t, "far:\n.zero 9000000\nCALL far\nHLT\n", codeImmediateTooBig)
+	assemble(t, "JMP far\n.zero 8000000\nfar:\nHLT\n")
+}
+
+func TestImmediateRanges(t *testing.T) {
+	var tests = map[string]bool{
+		"ADDIB R1 -128": true, "ADDIB R1 127": true, "ADDIB R1 128": false, "ADDIB R1 255": false,
+		"ANDIB R1 255": true, "ANDIB R1 0": true, "ANDIB R1 -1": false, "ANDIB R1 256": false,
+		"PUSHIW 32767": true, "PUSHIW 65535": false, "MOV1W R1 65535": true, "MOV1W R1 -1": false,
+		"SHILI R1 200": true, "PUSHIT -8388608": true, "PUSHIT 8388608": false,
+	}
+	for line, valid := range tests {
+		if valid {
+			assemble(t, line+"\nHLT\n")
+		} else {
+			expectError(t, line+"\nHLT\n", codeImmediateTooBig)
+		}
+	}
+}
+
+// everyOp.vasm must use every operation, so that every encoder path runs.
+func TestEveryOp(t *testing.T) {
+	source, err := os.ReadFile("assembly_test/everyOp.vasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, file := assemble(t, string(source))
+	var used map[int]bool = make(map[int]bool)
+	for _, sec := range file.Sections {
+		for i := 0; sec.Kind == sectionCode && i < len(sec.Content); i += 4 {
+			used[int(sec.Content[i])] = true
+		}
+	}
+	for mnemonic, opcode := range mnemonicToOpcode {
+		if mnemonic == "JMP" || mnemonic == "CALL" {
+			// they become JMPB, JMPW or JMPT and CALLB, CALLW or CALLT
+			continue
+		} else if !used[opcode] {
+			t.Errorf("%s is not used", mnemonic)
+		}
+	}
+}
+
+// The diagnostics name READ and WRT, not the forms splitAddress gives them.
+func TestAddressDiagnostics(t *testing.T) {
+	for _, source := range []string{"READ R1 @8 *R2+4000\nHLT\n", "WRT @8 *R2-3000 R1\nHLT\n", "WRT @8 *R2+R3*3 R1\nHLT\n"} {
+		var a *Assembler = NewAssembler(false)
+		a.Assemble("test.vasm", source)
+		if len(a.Diagnostics) == 0 {
+			t.Errorf("Assemble(%q) gave no diagnostic", source)
+		}
+		for _, diagnostic := range a.Diagnostics {
+			if strings.Contains(diagnostic.Message, "READO") || strings.Contains(diagnostic.Message, "WRTO") || strings.Contains(diagnostic.Message, "READX") || strings.Contains(diagnostic.Message, "WRTX") {
+				t.Errorf("Assemble(%q) gave %q", source, diagnostic.Message)
+			}
+		}
+	}
+}
+
+// assemble assembles source, failing the test if it has errors.
+func assemble(t *testing.T, source string) (*Assembler, bytecodeFile) {
+	t.Helper()
+	var a *Assembler = NewAssembler(false)
+	file, err := a.Assemble("test.vasm", source)
+	if err != nil {
+		t.Fatalf("Assemble(%q) failed: %v", source, a.Diagnostics)
+	}
+	return a, file
+}
+
+// expectError assembles source and checks that it fails with a diagnostic of
+// the given code.
+func expectError(t *testing.T, source string, code string) {
+	t.Helper()
+	var a *Assembler = NewAssembler(false)
+	if _, err := a.Assemble("test.vasm", source); err == nil || !hasCode(a.Diagnostics, code) {
+		t.Errorf("Assemble(%q) gave %v, want a %s", source, a.Diagnostics, code)
+	}
+}
+
+func hasCode(diagnostics []Diagnostic, code string) bool {
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Code == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"hash/crc32"
+	"os"
+)
+
+// A .vbc file is laid out as follows, every field being little-endian like
+// the values the VM reads and writes in RAM :
+//
+//	offset  size  field
+//	0       4     magic number "VBC\x1A"
+//	4       2     format version
+//	6       2     ISA version the program was assembled for
+//	8       4     entry point (address of the first executed instruction)
+//	12      2     number of sections
+//	14      2     reserved (0)
+//	16      4     CRC-32 (IEEE) of the whole file, this field being 0
+//	20      16*n  section table
+//	...           section contents, in the order of the section table
+//
+// Each entry of the section table is :
+//
+//	offset  size  field
+//	0       1     kind (sectionCode, sectionData or sectionBss)
+//	1       3     reserved (0)
+//	4       4     load address in RAM
+//	8       4     offset of the content in the file (0 for sectionBss)
+//	12      4     size of the content
+//
+// The content of a sectionBss is not stored, the loader fills it with 0.
+// The format and the ISA versions must be the ones of the VM, a file made by
+// an older version of the assembler has to be assembled again.
+
+const vbcMagic string = "VBC\x1A"
+const vbcFormatVersion uint16 = 3
+const vbcHeaderSize uint32 = 20
+const vbcSectionEntrySize uint32 = 16
+
+const (
+	sectionCode uint8 = iota + 1
+	sectionData
+	sectionBss
+)
+
+type section struct {
+	Kind    uint8
+	Address uint32
+	Content []uint8
+}
+
+type bytecodeFile struct {
+	FormatVersion uint16
+	ISAVersion    uint16
+	Entry         uint32
+	Sections      []section
+}
+
+//////////////
+// ENCODING //
+//////////////
+
+func newBytecodeFile(sections []section) bytecodeFile {
+	return bytecodeFile{
+		FormatVersion: vbcFormatVersion,
+		ISAVersion:    isaVersion,
+		Entry:         0,
+		Sections:      sections,
+	}
+}
+
+func encodeBytecodeFile(file bytecodeFile) []uint8 {
+	var body []uint8
+	var contentOffset uint32 = vbcHeaderSize + vbcSectionEntrySize*uint32(len(file.Sections))
+	for _, sec := range file.Sections {
+		body = append(body, sec.Kind, 0, 0, 0)
+		body = appendUint32(body, sec.Address)
+		if sec.Kind == sectionBss {
+			body = appendUint32(body, 0)
+		} else {
+			body = appendUint32(body, contentOffset)
+			contentOffset += uint32(len(sec.Content))
+		}
+		body = appendUint32(body, uint32(len(sec.Content)))
+	}
+	for _, sec := range file.Sections {
+		if sec.Kind != sectionBss {
+			body = append(body, sec.Content...)
+		}
+	}
+
+	var content []uint8 = []uint8(vbcMagic)
+	content = appendUint16(content, file.FormatVersion)
+	content = appendUint16(content, file.ISAVersion)
+	content = appendUint32(content, file.Entry)
+	content = appendUint16(content, uint16(len(file.Sections)))
+	content = appendUint16(content, 0)
+	content = appendUint32(content, 0)
+	content = append(content, body...)
+	copy(content[16:], appendUint32(nil, checksumOf(content)))
+	return content
+}
+
+// checksumOf gives the CRC of the .vbc file content, its CRC field being
+// taken as 0.
+func checksumOf(content []uint8) uint32 {
+	var crc uint32 = crc32.ChecksumIEEE(content[:16])
+	crc = crc32.Update(crc, crc32.IEEETable, []uint8{0, 0, 0, 0})
+	return crc32.Update(crc, crc32.IEEETable, content[vbcHeaderSize:])
+}
+
+func writeBytecodeFile(path string, file bytecodeFile) error {
+	return os.WriteFile(path, encodeBytecodeFile(file), 0644)
+}
+
+//////////////
+// DECODING //
+//////////////
+
+func decodeBytecodeFile(content []uint8) (bytecodeFile, error) {
+	var file bytecodeFile
+	if uint32(len(content)) < vbcHeaderSize || string(content[:4]) != vbcMagic {
+		return file, errors.New("not a .vbc file (bad magic number)")
+	}
+	file.FormatVersion = readUint16(content[4:])
+	file.ISAVersion = readUint16(content[6:])
+	file.Entry = readUint32(content[8:])
+	var sectionCount uint32 = uint32(readUint16(content[12:]))
+	var checksum uint32 = readUint32(content[16:])
+
+	if file.FormatVersion != vbcFormatVersion {
+		return file, errors.New("unsupported format version " + intToStr(int(file.FormatVersion)) + ", expected " + intToStr(int(vbcFormatVersion)) + ", assemble it again")
+	}
+	if file.ISAVersion != isaVersion {
+		return file, errors.New("assembled for ISA version " + intToStr(int(file.ISAVersion)) + " but this VM implements version " + intToStr(int(isaVersion)) + ", assemble it again")
+	}
+	if checksumOf(content) != checksum {
+		return file, errors.New("checksum mismatch, the file is corrupted")
+	}
+
+	var tableEnd uint64 = uint64(vbcHeaderSize) + uint64(vbcSectionEntrySize)*uint64(sectionCount)
+	if tableEnd > uint64(len(content)) {
+		return file, errors.New("truncated section table")
+	}
+	for i := uint32(0); i < sectionCount; i++ {
+		var entry []uint8 = content[vbcHeaderSize+i*vbcSectionEntrySize:]
+		var kind uint8 = entry[0]
+		var offset uint64 = uint64(readUint32(entry[8:]))
+		var size uint64 = uint64(readUint32(entry[12:]))
+		if kind != sectionCode && kind != sectionData && kind != sectionBss {
+			return file, errors.New("unknown section kind " + intToStr(int(kind)))
+		}
+		var sectionContent []uint8
+		if kind == sectionBss {
+			sectionContent = make([]uint8, size)
+		} else if offset < tableEnd || offset+size > uint64(len(content)) {
+			return file, errors.New("section " + intToStr(int(i)) + " lies outside of the file")
+		} else {
+			sectionContent = content[offset : offset+size]
+		}
+		file.Sections = append(file.Sections, section{
+			Kind:    kind,
+			Address: readUint32(entry[4:]),
+			Content: sectionContent,
+		})
+	}
+	return file, nil
+}
+
+func readBytecodeFile(path string) (bytecodeFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return bytecodeFile{}, err
+	}
+	return decodeBytecodeFile(content)
+}
+
+// checkFitsInRAM verifies that every section is below the stack of a RAM of
+// ramSize bytes, and that the entry point is the start of an instruction of
+// the code section.
+func (file bytecodeFile) checkFitsInRAM(ramSize uint32) error {
+	var stackStart uint32 = ramSize - (ramSize >> 2)
+	var entryInCode bool = false
+	for _, sec := range file.Sections {
+		if uint64(sec.Address)+uint64(len(sec.Content)) > uint64(stackStart) {
+			return errors.New("section at address " + intToStr(int(sec.Address)) + " does not fit below the stack, which starts at address " + intToStr(int(stackStart)) + " with " + intToStr(int(ramSize)) + " bytes of RAM")
+		}
+		if sec.Kind == sectionCode && file.Entry >= sec.Address && file.Entry < sec.Address+uint32(len(sec.Content)) {
+			entryInCode = (file.Entry-sec.Address)%4 == 0
+		}
+	}
+	if !entryInCode {
+		return errors.New("entry point " + intToStr(int(file.Entry)) + " is not an instruction of the code section")
+	}
+	return nil
+}
+
+///////////
+// UTILS //
+///////////
+
+func appendUint16(content []uint8, x uint16) []uint8 {
+	return append(content, uint8(x), uint8(x>>8))
+}
+
+func appendUint32(content []uint8, x uint32) []uint8 {
+	return append(content, uint8(x), uint8(x>>8), uint8(x>>16), uint8(x>>24))
+}
+
+func readUint16(content []uint8) uint16 {
+	return uint16(content[0]) | uint16(content[1])<<8
+}
+
+func readUint32(content []uint8) uint32 {
+	return uint32(content[0]) | uint32(content[1])<<8 | uint32(content[2])<<16 | uint32(content[3])<<24
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testFile() bytecodeFile {
+	var file bytecodeFile = newBytecodeFile([]section{
+		{Kind: sectionCode, Address: 0, Content: []uint8{uint8(INCR), 1, 0, 0, uint8(HLT), 0, 0, 0}},
+		{Kind: sectionData, Address: 8, Content: []uint8{1, 2, 3}},
+		{Kind: sectionBss, Address: 12, Content: make([]uint8, 4)},
+	})
+	file.Entry = 4
+	return file
+}
+
+func TestBytecodeFileRoundTrip(t *testing.T) {
+	var file bytecodeFile = testFile()
+	decoded, err := decodeBytecodeFile(encodeBytecodeFile(file))
+	if err != nil {
+		t.Fatalf("decodeBytecodeFile failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, file) {
+		t.Errorf("decoded %+v, want %+v", decoded, file)
+	}
+}
+
+// The CRC covers the header too, so changing the entry point is detected.
+func TestBytecodeFileCorrupted(t *testing.T) {
+	var content []uint8 = encodeBytecodeFile(testFile())
+	for _, offset := range []int{8, 14, int(vbcHeaderSize) + 4, len(content) - 1} {
+		var corrupted []uint8 = append([]uint8(nil), content...)
+		corrupted[offset] ^= 0x10
+		if _, err := decodeBytecodeFile(corrupted); err == nil {
+			t.Errorf("changing the byte %d was not detected", offset)
+		}
+	}
+}
+
+func TestBytecodeFileVersions(t *testing.T) {
+	var file bytecodeFile = testFile()
+	file.ISAVersion = isaVersion - 1
+	if _, err := decodeBytecodeFile(encodeBytecodeFile(file)); err == nil {
+		t.Errorf("a file of ISA version %d was accepted by a VM of version %d", file.ISAVersion, isaVersion)
+	}
+
+	file = testFile()
+	file.FormatVersion = vbcFormatVersion - 1
+	if _, err := decodeBytecodeFile(encodeBytecodeFile(file)); err == nil {
+		t.Errorf("a file of format version %d was accepted", file.FormatVersion)
+	}
+}
@@ -2,13 +2,71 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"math/bits"
 )
 
-const RAMSize uint32 = 1024
+const defaultRAMSize uint32 = 1024
 
-var RAM [RAMSize]uint8
-var registers []uint64 = []uint64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, uint64(RAMSize - 1), uint64(RAMSize - 1)}
+// Machine is one instance of the virtual computer. Every machine owns its
+// memory, registers and program counter, so several of them can run side by
+// side in the same process.
+//
+// The RAM below CodeSize holds the program and cannot be written, by default
+// it is everything below the stack. LoadFile sets it to the end of the code
+// section, so the data placed after it is writable.
+type Machine struct {
+	RAM       []uint8
+	Registers [16]uint64
+	PC        uint32
+	RAMSize   uint32
+	CodeSize  uint32
+}
+
+// NewMachine creates a machine with ramSize bytes of RAM, rounded up to a
+// multiple of 4 so that every instruction fits.
+func NewMachine(ramSize uint32) *Machine {
+	ramSize = (ramSize + 3) &^ 3
+	var m *Machine = &Machine{RAM: make([]uint8, ramSize), RAMSize: ramSize}
+	m.CodeSize = m.stackLimit()
+	m.Reset()
+	return m
+}
+
+// Reset clears the registers and puts the program counter back to 0, the RAM
+// is left untouched so a loaded program can be executed again.
+func (m *Machine) Reset() {
+	m.Registers = [16]uint64{}
+	m.Registers[14] = uint64(m.RAMSize)
+	m.Registers[15] = uint64(m.RAMSize)
+	m.PC = 0
+}
+
+// Load copies content into the RAM starting at address.
+func (m *Machine) Load(address uint32, content []uint8) {
+	copy(m.RAM[address:], content)
+}
+
+// LoadFile places every section of file at its address, protects the code
+// section against writes and sets the program counter to the entry point.
+func (m *Machine) LoadFile(file bytecodeFile) error {
+	err := file.checkFitsInRAM(m.RAMSize)
+	if err != nil {
+		return err
+	}
+	m.CodeSize = 0
+	for _, sec := range file.Sections {
+		m.Load(sec.Address, sec.Content)
+		if sec.Kind == sectionCode {
+			m.CodeSize = max(m.CodeSize, sec.Address+uint32(len(sec.Content)))
+		}
+	}
+	m.PC = file.Entry
+	return nil
+}
+
+// isaVersion is written in every .vbc file and must be increased each time
+// an opcode is added or its behaviour changes.
+const isaVersion uint16 = 11
 
 const (
 	HLT int = iota
@@ -66,21 +124,94 @@ const (
 	RET
 	WRT
 	READ
+	SEXT8
+	SEXT16
+	SEXT32
+	ZEXT8
+	ZEXT16
+	ZEXT32
+	SUB
+	SUBIB
+	SUBIW
+	NEG
+	XOR
+	XORIB
+	XORIW
+	ROL
+	ROLI
+	ROR
+	RORI
+	SAR
+	SARI
+	MOVL
+	JMPR
+	CALLR
+	READO
+	WRTO
+	READX
+	WRTX
 )
 
 /////////////////////////
 // Execute the program //
 /////////////////////////
 
-func executeProgram() {
-	var stackUpperBound uint32 = uint32(RAMSize - (RAMSize >> 2) - 1)
-	var stackLowerBound uint32 = uint32(RAMSize - 1)
-loop:
-	for i := uint32(0); i < RAMSize; i++ {
+// registerOperands has, for every opcode, the bit j set when its operand byte
+// j+1 is a register number, so executeProgram can check it before using it as
+// an index. READO, WRTO, READX and WRTX pack their registers in nibbles, which
+// are always valid.
+var registerOperands [256]uint8 = registerOperandBytes()
+
+func registerOperandBytes() [256]uint8 {
+	var result [256]uint8
+	for mnemonic, kinds := range syntaxRules {
+		var opcode int = mnemonicToOpcode[mnemonic]
+		if opcode == READO || opcode == WRTO || opcode == READX || opcode == WRTX {
+			continue
+		}
+		for j, kind := range kinds {
+			if kind == "Register" || kind == "Address" {
+				result[opcode] |= 1 << j
+			}
+		}
+	}
+	return result
+}
+
+// checkRegisterOperands returns a fault when one of the register operands of
+// the instruction at pc, given by registerOperands, is not between 0 and 15.
+func (m *Machine) checkRegisterOperands(pc uint32, operands uint8) *Fault {
+	for j := range uint32(3) {
+		if operands&(1<<j) == 0 {
+			continue
+		} else if pc+1+j >= m.RAMSize {
+			return m.fault(OutOfBounds, pc, "the instruction goes past the end of the RAM")
+		} else if m.RAM[pc+1+j] > 15 {
+			return m.fault(IllegalOperand, pc, "register "+intToStr(int(m.RAM[pc+1+j]))+" does not exist, there are only 16 registers")
+		}
+	}
+	return nil
+}
+
+// executeProgram runs the machine from m.PC until HLT. It returns nil once
+// HLT is reached, or a *Fault if the program cannot continue, in which case
+// m.PC is the address of the faulting instruction.
+func (m *Machine) executeProgram() error {
+	var RAM []uint8 = m.RAM
+	var RAMSize uint32 = m.RAMSize
+	var registers *[16]uint64 = &m.Registers
+	var i uint32
+	for i = m.PC; i < RAMSize; i++ {
 		//var debugVariable uint32 = i
+		if operands := registerOperands[RAM[i]]; operands != 0 {
+			if f := m.checkRegisterOperands(i, operands); f != nil {
+				return f
+			}
+		}
 		switch RAM[i] {
 		case uint8(HLT):
-			break loop
+			m.PC = i
+			return nil
 		case uint8(AND):
 			i += 1
 			var arg1 uint8 = RAM[i]
@@ -119,10 +250,28 @@ loop:
 			var arg3 uint8 = RAM[i+3]
 			registers[arg1] = registers[arg1] | (uint64(arg2) | (uint64(arg3) << 8))
 			i += 3
+		case uint8(XOR):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = registers[arg1] ^ registers[arg2]
+			i += 3
+		case uint8(XORIB):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = registers[arg1] ^ uint64(arg2)
+			i += 3
+		case uint8(XORIW):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			var arg3 uint8 = RAM[i+3]
+			registers[arg1] = registers[arg1] ^ (uint64(arg2) | (uint64(arg3) << 8))
+			i += 3
 		case uint8(NOT):
 			var arg uint8 = RAM[i+1]
 			registers[arg] = ^registers[arg]
 			i += 3
+		// Shifting by 64 or more gives 0 for SHIL and SHIR, and fills every bit
+		// with the sign bit for SAR. Rotations only use the amount modulo 64.
 		case uint8(SHIL):
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint8 = RAM[i+2]
@@ -131,18 +280,48 @@ loop:
 		case uint8(SHILI):
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint8 = RAM[i+2]
-			registers[arg1] = registers[arg1] >> arg2
+			registers[arg1] = registers[arg1] << arg2
 			i += 3
 		case uint8(SHIR):
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint8 = RAM[i+2]
-			registers[arg1] = registers[arg1] << registers[arg2]
+			registers[arg1] = registers[arg1] >> registers[arg2]
 			i += 3
 		case uint8(SHIRI):
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint8 = RAM[i+2]
 			registers[arg1] = registers[arg1] >> arg2
 			i += 3
+		case uint8(SAR):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = uint64(int64(registers[arg1]) >> registers[arg2])
+			i += 3
+		case uint8(SARI):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = uint64(int64(registers[arg1]) >> arg2)
+			i += 3
+		case uint8(ROL):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = bits.RotateLeft64(registers[arg1], int(registers[arg2]&63))
+			i += 3
+		case uint8(ROLI):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = bits.RotateLeft64(registers[arg1], int(arg2&63))
+			i += 3
+		case uint8(ROR):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = bits.RotateLeft64(registers[arg1], -int(registers[arg2]&63))
+			i += 3
+		case uint8(RORI):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] = bits.RotateLeft64(registers[arg1], -int(arg2&63))
+			i += 3
 		case uint8(ADD):
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint8 = RAM[i+2]
@@ -166,22 +345,99 @@ loop:
 				registers[arg1] += arg2
 			}
 			i += 3
+		case uint8(SUB):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] -= registers[arg2]
+			i += 3
+		case uint8(SUBIB):
+			var arg1 uint8 = RAM[i+1]
+			registers[arg1] -= uint64(int64(int8(RAM[i+2])))
+			i += 3
+		case uint8(SUBIW):
+			var arg1 uint8 = RAM[i+1]
+			registers[arg1] -= uint64(int64(int16(uint16(RAM[i+2]) | uint16(RAM[i+3])<<8)))
+			i += 3
+		case uint8(NEG):
+			registers[RAM[i+1]] = -registers[RAM[i+1]]
+			i += 3
 		case uint8(INCR):
 			registers[RAM[i+1]] += 1
 			i += 3
 		case uint8(DECR):
 			registers[RAM[i+1]] -= 1
 			i += 3
-		// case MUL
-		// case MULIB
-		// case MULIW
-		// case DIV
-		// case DIVIB
-		// case DIVIW
-		// case MOD
-		// case MODIB
-		// case MODIW
-		// case CLEAR
+		// MUL keeps the low 64 bits of the product, which are the same for
+		// signed and unsigned numbers. DIV and MOD are signed, the quotient is
+		// truncated toward zero and the remainder has the sign of the dividend.
+		// MIN_INT64 / -1 overflows back to MIN_INT64 (and MIN_INT64 MOD -1 is 0).
+		// Immediates are sign-extended like ADDIB and ADDIW.
+		case uint8(MUL):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1] *= registers[arg2]
+			i += 3
+		case uint8(MULIB):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 int64 = int64(int8(RAM[i+2]))
+			registers[arg1] = uint64(int64(registers[arg1]) * arg2)
+			i += 3
+		case uint8(MULIW):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 int64 = int64(int16(uint16(RAM[i+2]) | uint16(RAM[i+3])<<8))
+			registers[arg1] = uint64(int64(registers[arg1]) * arg2)
+			i += 3
+		case uint8(DIV):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			if registers[arg2] == 0 {
+				return m.fault(DivideByZero, i, "R"+intToStr(int(arg2))+" is 0")
+			}
+			registers[arg1] = uint64(int64(registers[arg1]) / int64(registers[arg2]))
+			i += 3
+		case uint8(DIVIB):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 int64 = int64(int8(RAM[i+2]))
+			if arg2 == 0 {
+				return m.fault(DivideByZero, i, "the immediate is 0")
+			}
+			registers[arg1] = uint64(int64(registers[arg1]) / arg2)
+			i += 3
+		case uint8(DIVIW):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 int64 = int64(int16(uint16(RAM[i+2]) | uint16(RAM[i+3])<<8))
+			if arg2 == 0 {
+				return m.fault(DivideByZero, i, "the immediate is 0")
+			}
+			registers[arg1] = uint64(int64(registers[arg1]) / arg2)
+			i += 3
+		case uint8(MOD):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			if registers[arg2] == 0 {
+				return m.fault(DivideByZero, i, "R"+intToStr(int(arg2))+" is 0")
+			}
+			registers[arg1] = uint64(int64(registers[arg1]) % int64(registers[arg2]))
+			i += 3
+		case uint8(MODIB):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 int64 = int64(int8(RAM[i+2]))
+			if arg2 == 0 {
+				return m.fault(DivideByZero, i, "the immediate is 0")
+			}
+			registers[arg1] = uint64(int64(registers[arg1]) % arg2)
+			i += 3
+		case uint8(MODIW):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 int64 = int64(int16(uint16(RAM[i+2]) | uint16(RAM[i+3])<<8))
+			if arg2 == 0 {
+				return m.fault(DivideByZero, i, "the immediate is 0")
+			}
+			registers[arg1] = uint64(int64(registers[arg1]) % arg2)
+			i += 3
+		case uint8(CLEAR):
+			registers[RAM[i+1]] = 0
+			i += 3
 		case uint8(MOV1B):
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint64 = uint64(RAM[i+2])
@@ -230,14 +486,83 @@ loop:
 			registers[arg1] &= 0x0000FFFFFFFFFFFF
 			registers[arg1] |= (arg2 << 48)
 			i += 3
-		// case MOVR
-		// case SWAP
-		// case PUSH
-		// case PUSHIB
-		// case PUSHIW
-		// case PUSHIT
-		// case POP
-		// case PEEK
+		// MOVL loads the address of a label, given by its offset from the
+		// address of the MOVL itself like the offset of a jump.
+		case uint8(MOVL):
+			var arg1 uint8 = RAM[i+1]
+			var offset uint32 = uint32(RAM[i+2]) | uint32(RAM[i+3])<<8
+			if offset&0x8000 != 0 {
+				offset |= 0xFFFF0000
+			}
+			registers[arg1] = uint64(i + offset)
+			i += 3
+		case uint8(MOVR):
+			registers[RAM[i+1]] = registers[RAM[i+2]]
+			i += 3
+		case uint8(SWAP):
+			var arg1 uint8 = RAM[i+1]
+			var arg2 uint8 = RAM[i+2]
+			registers[arg1], registers[arg2] = registers[arg2], registers[arg1]
+			i += 3
+		// SEXTn and ZEXTn widen the n lowest bits of a register to 64 bits,
+		// copying the sign bit (SEXT) or filling with 0 (ZEXT).
+		case uint8(SEXT8):
+			registers[RAM[i+1]] = uint64(int64(int8(registers[RAM[i+1]])))
+			i += 3
+		case uint8(SEXT16):
+			registers[RAM[i+1]] = uint64(int64(int16(registers[RAM[i+1]])))
+			i += 3
+		case uint8(SEXT32):
+			registers[RAM[i+1]] = uint64(int64(int32(registers[RAM[i+1]])))
+			i += 3
+		case uint8(ZEXT8):
+			registers[RAM[i+1]] &= 0xFF
+			i += 3
+		case uint8(ZEXT16):
+			registers[RAM[i+1]] &= 0xFFFF
+			i += 3
+		case uint8(ZEXT32):
+			registers[RAM[i+1]] &= 0xFFFFFFFF
+			i += 3
+		case uint8(PUSH):
+			if f := m.push(registers[RAM[i+1]], i); f != nil {
+				return f
+			}
+			i += 3
+		case uint8(PUSHIB):
+			if f := m.push(uint64(int64(int8(RAM[i+1]))), i); f != nil {
+				return f
+			}
+			i += 3
+		case uint8(PUSHIW):
+			if f := m.push(uint64(int64(int16(uint16(RAM[i+1])|uint16(RAM[i+2])<<8))), i); f != nil {
+				return f
+			}
+			i += 3
+		case uint8(PUSHIT):
+			var value uint64 = uint64(RAM[i+1]) | uint64(RAM[i+2])<<8 | uint64(RAM[i+3])<<16
+			if value&0x800000 != 0 {
+				value |= 0xFFFFFFFFFF000000
+			}
+			if f := m.push(value, i); f != nil {
+				return f
+			}
+			i += 3
+		case uint8(POP):
+			value, f := m.peek(i)
+			if f != nil {
+				return f
+			}
+			registers[15] += 8
+			registers[RAM[i+1]] = value
+			i += 3
+		case uint8(PEEK):
+			value, f := m.peek(i)
+			if f != nil {
+				return f
+			}
+			registers[RAM[i+1]] = value
+			i += 3
 		case uint8(CMP):
 			i += 1
 			var arg1 uint8 = RAM[i]
@@ -248,121 +573,275 @@ loop:
 			switch arg3 {
 			case 1:
 				if !(registers[arg1]^0x8000000000000000 < registers[arg2]^0x8000000000000000) {
-					i += 3
+					i += 4
 				}
 			case 2:
 				if !(registers[arg1]^0x8000000000000000 > registers[arg2]^0x8000000000000000) {
-					i += 3
+					i += 4
 				}
 			case 3:
 				if registers[arg1] != registers[arg2] {
-					i += 3
+					i += 4
 				}
 			case 4:
 				if registers[arg1] == registers[arg2] {
-					i += 3
+					i += 4
 				}
 			}
+		// The offset of a jump is relative to the address of the jump itself,
+		// 1 is removed because the loop adds 1 to i after each instruction.
 		case uint8(JMPB):
 			var offset uint32
 			offset = uint32(RAM[i+1])
 			if offset&0x80 != 0 {
 				offset |= 0xFFFFFF00
 			}
-			i += offset
+			if f := m.checkJumpTarget(uint64(i+offset), i, "jump address"); f != nil {
+				return f
+			}
+			i += offset - 1
 		case uint8(JMPW):
 			var offset uint32
 			offset = uint32(RAM[i+1]) | uint32(RAM[i+2])<<8
 			if offset&0x8000 != 0 {
 				offset |= 0xFFFF0000
 			}
-			i += offset
+			if f := m.checkJumpTarget(uint64(i+offset), i, "jump address"); f != nil {
+				return f
+			}
+			i += offset - 1
 		case uint8(JMPT):
 			var offset uint32
 			offset = uint32(RAM[i+1]) | uint32(RAM[i+2])<<8 | uint32(RAM[i+3])<<16
 			if offset&0x800000 != 0 {
 				offset |= 0xFF000000
 			}
-			i += offset
-		// case CALLB
-		// case CALLW
-		// case CALLT
-		case uint8(RET):
-			// TO DO
-			if uint32(registers[15]) == uint32(RAMSize-1) {
-				log.Fatal("Cannot return because stack is empty at memory address : " + intToStr(int(i)))
+			if f := m.checkJumpTarget(uint64(i+offset), i, "jump address"); f != nil {
+				return f
 			}
-			var newAddress uint32
-			registers[15] += 8
-			newAddress = uint32(RAM[uint32(registers[15])]) | uint32(RAM[uint32(registers[15])-1])<<8 | uint32(RAM[uint32(registers[15])-2])<<16 | uint32(RAM[uint32(registers[15])-3])<<24
-			if newAddress > stackUpperBound {
-				log.Fatal("Address out of bounds")
+			i += offset - 1
+		// A CALL pushes the address of the instruction that follows it (the
+		// return address) as a 64 bits value, then jumps like JMP. RET pops
+		// this value and continues from there.
+		case uint8(CALLB):
+			var offset uint32
+			offset = uint32(RAM[i+1])
+			if offset&0x80 != 0 {
+				offset |= 0xFFFFFF00
 			}
-			i = newAddress
-
-		case uint8(PUSH):
-			// TO Do
-			var arg uint8 = RAM[i+1]
-			if uint32(registers[15]) <= stackUpperBound {
-				log.Fatal("Stack overflow (but not the website unfortunately)")
+			if f := m.checkJumpTarget(uint64(i+offset), i, "call address"); f != nil {
+				return f
 			}
-			for j := range 8 {
-				RAM[uint32(registers[15])-uint32(j)] = uint8(registers[arg] >> (8 * j))
+			if f := m.push(uint64(i+4), i); f != nil {
+				return f
 			}
-			registers[15] -= 8
-			i += 1
-		case uint8(POP):
-			// TO DO
-			var arg uint8 = RAM[i+1]
-			if uint32(registers[15]) >= stackLowerBound {
-				log.Fatal("Stack underflow")
+			i += offset - 1
+		case uint8(CALLW):
+			var offset uint32
+			offset = uint32(RAM[i+1]) | uint32(RAM[i+2])<<8
+			if offset&0x8000 != 0 {
+				offset |= 0xFFFF0000
 			}
-			registers[15] += 8
-			var number uint64
-			for j := range 8 {
-				number += uint64(RAM[uint32(registers[15])-uint32(j)]) << (8 * j)
+			if f := m.checkJumpTarget(uint64(i+offset), i, "call address"); f != nil {
+				return f
 			}
-			registers[arg] = number
-			i += 1
+			if f := m.push(uint64(i+4), i); f != nil {
+				return f
+			}
+			i += offset - 1
+		case uint8(CALLT):
+			var offset uint32
+			offset = uint32(RAM[i+1]) | uint32(RAM[i+2])<<8 | uint32(RAM[i+3])<<16
+			if offset&0x800000 != 0 {
+				offset |= 0xFF000000
+			}
+			if f := m.checkJumpTarget(uint64(i+offset), i, "call address"); f != nil {
+				return f
+			}
+			if f := m.push(uint64(i+4), i); f != nil {
+				return f
+			}
+			i += offset - 1
+		// JMPR and CALLR jump to the address held in a register, which must
+		// be an instruction of the program like the return address of RET.
+		case uint8(JMPR):
+			var target uint64 = registers[RAM[i+1]]
+			if f := m.checkJumpTarget(target, i, "jump address"); f != nil {
+				return f
+			}
+			i = uint32(target) - 1
+		case uint8(CALLR):
+			var target uint64 = registers[RAM[i+1]]
+			if f := m.checkJumpTarget(target, i, "call address"); f != nil {
+				return f
+			}
+			if f := m.push(uint64(i+4), i); f != nil {
+				return f
+			}
+			i = uint32(target) - 1
+		case uint8(RET):
+			returnAddress, f := m.peek(i)
+			if f != nil {
+				if f.Kind == StackUnderflow {
+					f.Message = "cannot return because the stack is empty"
+				}
+				return f
+			}
+			if f := m.checkJumpTarget(returnAddress, i, "return address"); f != nil {
+				return f
+			}
+			registers[15] += 8
+			i = uint32(returnAddress) - 1
 		case uint8(WRT):
-			// TO DO
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint8 = RAM[i+2]
-			if registers[arg2] <= uint64(stackUpperBound) {
-				log.Fatal("You cannot modify the program while running")
-			} else if registers[arg2] > uint64(RAMSize) {
-				log.Fatal("Address out of bounds")
-			}
 			var arg3 uint8 = RAM[i+3]
-			var numberToStore uint64 = registers[arg3]
-			var bytes uint8
-			for j := range arg1 {
-				bytes = uint8(numberToStore & 255)
-				RAM[registers[arg2]+uint64(j)] = bytes
-				numberToStore = numberToStore >> 8
+			if f := m.store(registers[arg2], arg1, registers[arg3], i); f != nil {
+				return f
 			}
 			i += 3
 		case uint8(READ):
-			// TO DO
 			var arg1 uint8 = RAM[i+1]
 			var arg2 uint8 = RAM[i+2]
 			var arg3 uint8 = RAM[i+3]
-			if registers[arg3] > uint64(RAMSize) {
-				log.Fatal("Address out of bounds")
+			value, f := m.load(registers[arg3], arg2, i)
+			if f != nil {
+				return f
+			}
+			registers[arg1] = value
+			i += 3
+		// READO and WRTO add a signed 12 bits displacement to the base
+		// register, READX and WRTX add the index register times 1, 2, 4 or 8.
+		// load and store check the size like for READ and WRT.
+		case uint8(READO), uint8(WRTO), uint8(READX), uint8(WRTX):
+			var data uint8 = RAM[i+1] & 0xF
+			var base uint8 = RAM[i+1] >> 4
+			var size uint8
+			var address uint64
+			if RAM[i] == uint8(READO) || RAM[i] == uint8(WRTO) {
+				size = RAM[i+2] & 0xF
+				var displacement uint64 = uint64(RAM[i+2]>>4) | uint64(RAM[i+3])<<4
+				if displacement&0x800 != 0 {
+					displacement |= 0xFFFFFFFFFFFFF000
+				}
+				address = registers[base] + displacement
+			} else if RAM[i+2]>>4 > 3 {
+				return m.fault(IllegalOperand, i, "the scale of the index must be 1, 2, 4 or 8, not 2^"+intToStr(int(RAM[i+2]>>4)))
+			} else {
+				size = RAM[i+3]
+				address = registers[base] + registers[RAM[i+2]&0xF]<<(RAM[i+2]>>4)
 			}
-			var storedNumber uint64 = 0
-			for j := 0; uint8(j) < arg2; j++ {
-				storedNumber += uint64(RAM[registers[arg3]+uint64(j)]) << (8 * j)
+			if RAM[i] == uint8(READO) || RAM[i] == uint8(READX) {
+				value, f := m.load(address, size, i)
+				if f != nil {
+					return f
+				}
+				registers[data] = value
+			} else if f := m.store(address, size, registers[data], i); f != nil {
+				return f
 			}
-			registers[arg1] = storedNumber
 			i += 3
+		default:
+			return m.fault(IllegalOpcode, i, "opcode "+intToStr(int(RAM[i]))+" is not implemented by this machine")
 		}
 		//fmt.Println(debugVariable, opcodeToMnemonics[int(RAM[debugVariable])], registers)
 		//fmt.Println(RAM[3*(RAMSize>>2):])
 		//fmt.Println(RAM[RAMSize>>2 : RAMSize-(RAMSize>>2)])
 		//fmt.Println(RAM)
 	}
+	return m.fault(OutOfBounds, i, "the program counter left the RAM without reaching HLT")
+}
+
+///////////
+// STACK //
+///////////
+
+// The stack is the last quarter of the RAM and grows downward. R15 holds the
+// address of the value at the top of the stack, so it is equal to RAMSize
+// when the stack is empty. Every value takes 8 bytes stored little-endian,
+// which means READ R1 @64 *R15 reads the top of the stack.
+
+func (m *Machine) stackLimit() uint32 {
+	return m.RAMSize - (m.RAMSize >> 2)
+}
+
+func (m *Machine) push(value uint64, pc uint32) *Fault {
+	var sp uint64 = m.Registers[15]
+	if sp > uint64(m.RAMSize) || sp < uint64(m.stackLimit()) {
+		return m.fault(OutOfBounds, pc, "R15 ("+intToStr(int(sp))+") is outside of the stack")
+	} else if sp < uint64(m.stackLimit())+8 {
+		return m.fault(StackOverflow, pc, "stack overflow (but not the website unfortunately)")
+	}
+	sp -= 8
+	for j := range 8 {
+		m.RAM[sp+uint64(j)] = uint8(value >> (8 * j))
+	}
+	m.Registers[15] = sp
+	return nil
+}
+
+// load reads the size bytes at address, stored little-endian, for the
+// instruction at pc.
+func (m *Machine) load(address uint64, size uint8, pc uint32) (uint64, *Fault) {
+	if !isValidSize(size) {
+		return 0, m.fault(IllegalOperand, pc, "cannot read "+intToStr(int(size))+" bytes, the size must be 1, 2, 4 or 8")
+	} else if address >= uint64(m.RAMSize) || address+uint64(size) > uint64(m.RAMSize) {
+		return 0, m.fault(OutOfBounds, pc, "cannot read "+intToStr(int(size))+" bytes at address "+intToStr(int(address)))
+	}
+	var value uint64 = 0
+	for j := range uint64(size) {
+		value |= uint64(m.RAM[address+j]) << (8 * j)
+	}
+	return value, nil
+}
+
+// store writes the size lowest bytes of value at address, little-endian, for
+// the instruction at pc. The program itself cannot be modified.
+func (m *Machine) store(address uint64, size uint8, value uint64, pc uint32) *Fault {
+	if !isValidSize(size) {
+		return m.fault(IllegalOperand, pc, "cannot write "+intToStr(int(size))+" bytes, the size must be 1, 2, 4 or 8")
+	} else if address < uint64(m.CodeSize) {
+		return m.fault(WriteToCode, pc, "address "+intToStr(int(address))+" is in the program area, you cannot modify the program while running")
+	} else if address >= uint64(m.RAMSize) || address+uint64(size) > uint64(m.RAMSize) {
+		return m.fault(OutOfBounds, pc, "cannot write "+intToStr(int(size))+" bytes at address "+intToStr(int(address)))
+	}
+	for j := range uint64(size) {
+		m.RAM[address+j] = uint8(value >> (8 * j))
+	}
+	return nil
+}
+
+// checkJumpTarget returns a fault when target, the address a jump, a call or a
+// return of the instruction at pc goes to, is not an instruction of the
+// program. what names the address in the message.
+func (m *Machine) checkJumpTarget(target uint64, pc uint32, what string) *Fault {
+	if target >= uint64(m.CodeSize) || target%4 != 0 {
+		return m.fault(OutOfBounds, pc, what+" "+intToStr(int(target))+" is not an instruction of the program")
+	}
+	return nil
+}
+
+func isValidSize(size uint8) bool {
+	return size == 1 || size == 2 || size == 4 || size == 8
+}
+
+// peek returns the value at the top of the stack without removing it.
+func (m *Machine) peek(pc uint32) (uint64, *Fault) {
+	var sp uint64 = m.Registers[15]
+	if sp > uint64(m.RAMSize) || sp < uint64(m.stackLimit()) {
+		return 0, m.fault(OutOfBounds, pc, "R15 ("+intToStr(int(sp))+") is outside of the stack")
+	} else if sp+8 > uint64(m.RAMSize) {
+		return 0, m.fault(StackUnderflow, pc, "the stack is empty")
+	}
+	var value uint64
+	for j := range 8 {
+		value |= uint64(m.RAM[sp+uint64(j)]) << (8 * j)
+	}
+	return value, nil
+}
+
+func (m *Machine) printState() {
 	fmt.Println()
-	fmt.Println(registers)
-	fmt.Println(RAM)
+	fmt.Println(m.Registers)
+	fmt.Println(m.RAM)
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExecuteProgram(t *testing.T) {
+	expectRegisters(t, "MOV1B R1 5\nMOV1B R2 1\nloop:\nMUL R2 R1\nDECR R1\nCLEAR R3\nCMP R1 R3 NE\nJMP loop\nHLT\n", map[int]int64{2: 120})
+}
+
+// DIV and MOD are signed, the quotient is truncated toward zero and the
+// remainder has the sign of the dividend. MUL wraps around.
+func TestMulDivMod(t *testing.T) {
+	expectRegisters(t, `
+		LI R1, -7
+		MOV1B R2 2
+		MOVR R3 R1
+		DIV R3 R2
+		MOVR R4 R1
+		MOD R4 R2
+		MOVR R5 R1
+		MUL R5 R2
+		MOVR R6 R1
+		DIVIB R6 -2
+		MOVR R7 R1
+		MODIW R7 4
+		MOVR R8 R1
+		MULIB R8 -3
+		LI R9, 0x4000000000000001
+		MULIW R9 4
+		HLT
+	`, map[int]int64{3: -3, 4: -1, 5: -14, 6: 3, 7: -3, 8: 21, 9: 4})
+	expectRunFault(t, "MOV1B R1 1\nCLEAR R2\nDIV R1 R2\nHLT\n", DivideByZero)
+	expectRunFault(t, "MOV1B R1 1\nCLEAR R2\nMOD R1 R2\nHLT\n", DivideByZero)
+}
+
+// Every value takes 8 bytes on the stack, the immediates being sign-extended.
+func TestStack(t *testing.T) {
+	expectRegisters(t, `
+		MOV1B R1 5
+		PUSH R1
+		PUSHIB -1
+		PUSHIW 300
+		PUSHIT -2
+		POP R2
+		PEEK R3
+		POP R4
+		POP R5
+		READ R7 @64 *R15
+		POP R6
+		HLT
+	`, map[int]int64{2: -2, 3: 300, 4: 300, 5: -1, 6: 5, 7: 5, 15: int64(defaultRAMSize)})
+	expectRunFault(t, "POP R1\nHLT\n", StackUnderflow)
+	expectRunFault(t, "PEEK R1\nHLT\n", StackUnderflow)
+	expectRunFault(t, "loop:\nPUSH R1\nJMP loop\n", StackOverflow)
+}
+
+// CALL pushes the address of the next instruction, which RET pops.
+func TestCallAndReturn(t *testing.T) {
+	expectRegisters(t, `
+		CALL double
+		MOVR R3 R1
+		HLT
+		double:
+		MOV1B R1 21
+		CALL add
+		RET
+		add:
+		PEEK R2
+		ADD R1 R1
+		RET
+	`, map[int]int64{1: 42, 2: 20, 3: 42, 15: int64(defaultRAMSize)})
+	expectRunFault(t, "RET\nHLT\n", StackUnderflow)
+	expectRunFault(t, "PUSHIB 2\nRET\nHLT\n", OutOfBounds)
+	expectRunFault(t, "f:\nCALL f\n", StackOverflow)
+}
+
+func TestRegisterMoves(t *testing.T) {
+	expectRegisters(t, `
+		LI R1, 0x80
+		SEXT8 R1
+		LI R2, 0x8000
+		SEXT16 R2
+		LI R3, 0x80000000
+		SEXT32 R3
+		LI R4, 0x7F
+		SEXT8 R4
+		LI R5, -1
+		MOVR R6 R5
+		ZEXT8 R6
+		MOVR R7 R5
+		ZEXT16 R7
+		MOVR R8 R5
+		ZEXT32 R8
+		MOV1B R9 1
+		MOV1B R10 2
+		SWAP R9 R10
+		CLEAR R5
+		HLT
+	`, map[int]int64{1: -0x80, 2: -0x8000, 3: -0x80000000, 4: 0x7F, 5: 0, 6: 0xFF, 7: 0xFFFF, 8: 0xFFFFFFFF, 9: 2, 10: 1})
+}
+
+// SHIL and SHILI shift toward the most significant bits, SHIR and SHIRI
+// toward the least significant ones. Shifting by 64 or more gives 0, or the
+// sign bit everywhere for SAR, and the rotations use the amount modulo 64.
+func TestShiftsAndRotations(t *testing.T) {
+	expectRegisters(t, `
+		MOV1B R1 1
+		SHILI R1 4
+		MOV1B R2 32
+		SHIRI R2 4
+		MOV1B R0 3
+		MOV1B R3 1
+		SHIL R3 R0
+		MOV1B R4 64
+		SHIR R4 R0
+		LI R5, -16
+		SARI R5 2
+		LI R6, -16
+		SAR R6 R0
+		LI R7, 0x8000000000000001
+		ROLI R7 1
+		LI R8, 3
+		RORI R8 1
+		LI R9, 0x8000000000000001
+		ROL R9 R0
+		LI R10, 0x8000000000000001
+		ROR R10 R0
+		HLT
+	`, map[int]int64{1: 16, 2: 2, 3: 8, 4: 8, 5: -4, 6: -2, 7: 3, 8: -0x7FFFFFFFFFFFFFFF, 9: 12, 10: 0x3000000000000000})
+	expectRegisters(t, `
+		MOV1B R0 64
+		MOV1B R11 200
+		LI R1, -1
+		SHIL R1 R0
+		LI R2, -1
+		SHIR R2 R0
+		LI R3, -16
+		SAR R3 R0
+		LI R4, 16
+		SAR R4 R11
+		LI R5, 0x8000000000000001
+		ROL R5 R0
+		LI R6, 0x8000000000000001
+		ROLI R6 65
+		LI R7, 0x8000000000000001
+		RORI R7 200
+		LI R8, -1
+		SHILI R8 64
+		LI R9, -16
+		SARI R9 100
+		HLT
+	`, map[int]int64{1: 0, 2: 0, 3: -1, 4: 0, 5: -0x7FFFFFFFFFFFFFFF, 6: 3, 7: 0x0180000000000000, 8: 0, 9: -1})
+}
+
+// LI gives the register the whole value whatever it held before, including
+// when the value is an address.
+func TestLoadImmediate(t *testing.T) {
+	var values = []int64{0, 5, 255, 256, 0xFFFF, -1, -2, 0x10000, 0x123456789ABCDEF0, -0x8000000000000000, 0x7FFF0000FFFF0000, 0x0001000000000001}
+	for _, value := range values {
+		expectRegisters(t, "LI R1, -1\nLI R1, "+formatValue(value)+"\nHLT\n", map[int]int64{1: value})
+	}
+	expectRegisters(t, "LI R1, -1\nLI R1, end + 1\nend: HLT\n", map[int]int64{1: 33})
+}
+
+// MOVL gives the address of the label, before or after the MOVL.
+func TestMovl(t *testing.T) {
+	expectRegisters(t, `
+		start:
+		MOVL R1 end
+		MOVL R2 here
+		here:
+		MOVL R3 here
+		MOVL R4 start
+		end:
+		HLT
+	`, map[int]int64{1: 16, 2: 8, 3: 8, 4: 0})
+}
+
+func TestJumpToRegister(t *testing.T) {
+	expectRegisters(t, `
+		MOVL R1 skip
+		JMPR R1
+		MOV1B R2 1
+		skip:
+		MOVL R1 function
+		CALLR R1
+		MOV1B R4 1
+		HLT
+		function:
+		PEEK R3
+		RET
+	`, map[int]int64{2: 0, 3: 20, 4: 1, 15: int64(defaultRAMSize)})
+	expectRunFault(t, "MOV1B R1 2\nJMPR R1\nHLT\n", OutOfBounds)
+	expectRunFault(t, "LI R1, 4096\nCALLR R1\nHLT\n", OutOfBounds)
+}
+
+// SWITCH jumps to the entry of the table, or falls through when the
+// index is out of range, and gives R14 back in both cases.
+func TestSwitch(t *testing.T) {
+	var tests = []struct {
+		index string
+		r2    int64
+	}{
+		{"0", 10},
+		{"1", 11},
+		{"2", 12},
+		{"3", 9},
+		{"-1", 9},
+	}
+	for _, test := range tests {
+		expectRegisters(t, `
+			LI R14, 77
+			LI R1, `+test.index+`
+			SWITCH R1, table, 3
+			MOV1B R2 9
+			HLT
+			zero:
+			MOV1B R2 10
+			HLT
+			one:
+			MOV1B R2 11
+			HLT
+			two:
+			MOV1B R2 12
+			HLT
+			.data
+			table: .addr zero, one, two
+		`, map[int]int64{2: test.r2, 14: 77, 15: int64(defaultRAMSize)})
+	}
+}
+
+// The offset and the scaled index are added to the base register, and only
+// the bytes of the size are read or written.
+func TestOffsetAndIndexedAddresses(t *testing.T) {
+	expectRegisters(t, `
+		MOVL R1 buffer
+		LI R7, 0x1122334455667788
+		WRT @64 *R1+8 R7
+		READ R2 @64 *R1+8
+		MOVL R3 end
+		READ R4 @32 *R3-24
+		MOV1B R5 3
+		WRT @8 *R1+R5*8 R7
+		READ R6 @64 *R1+R5*8
+		READ R8 @16 *R1+R5*4
+		WRT @16 *R3-24 R5
+		READ R9 @64 *R1+8
+		HLT
+		.data
+		buffer: .zero 32
+		end:
+	`, map[int]int64{2: 0x1122334455667788, 4: 0x55667788, 6: 0x88, 8: 0x3344, 9: 0x1122334455660003})
+}
+
+// The register operands come from the RAM, which may hold anything.
+func TestIllegalRegisterOperand(t *testing.T) {
+	var programs = [][]uint8{
+		{uint8(INCR), 200, 0, 0},
+		{uint8(ADD), 1, 16, 0},
+		{uint8(CMP), 255, 1, 3},
+		{uint8(READ), 1, 8, 99},
+		{uint8(WRT), 8, 1, 16},
+		{uint8(JMPR), 16, 0, 0},
+	}
+	for _, program := range programs {
+		expectFault(t, defaultRAMSize, program, IllegalOperand)
+	}
+}
+
+func TestIllegalSize(t *testing.T) {
+	var programs = [][]uint8{
+		{uint8(READ), 1, 200, 2},
+		{uint8(READ), 1, 0, 2},
+		{uint8(WRT), 3, 2, 1},
+	}
+	for _, program := range programs {
+		expectFault(t, defaultRAMSize, program, IllegalOperand)
+	}
+}
+
+func TestIllegalAddressForms(t *testing.T) {
+	var programs = [][]uint8{
+		{uint8(READO), 0x21, 0x00, 0},
+		{uint8(READO), 0x21, 0x03, 0},
+		{uint8(WRTO), 0x21, 0x0F, 0},
+		{uint8(READX), 0x21, 0x43, 8},
+		{uint8(WRTX), 0x21, 0xF3, 8},
+		{uint8(READX), 0x21, 0x03, 5},
+	}
+	for _, program := range programs {
+		expectFault(t, defaultRAMSize, program, IllegalOperand)
+	}
+}
+
+// A READ or a WRT that does not fit in the RAM must not wrap around.
+func TestAccessOutsideOfTheRAM(t *testing.T) {
+	expectFault(t, 4, []uint8{uint8(READ), 1, 8, 2}, OutOfBounds)
+	expectFault(t, 64, []uint8{uint8(MOV1B), 2, 60, 0, uint8(READ), 1, 8, 2}, OutOfBounds)
+	expectFault(t, 64, []uint8{uint8(MOV1B), 2, 60, 0, uint8(WRT), 8, 2, 1}, OutOfBounds)
+	expectFault(t, 64, []uint8{uint8(NOT), 2, 0, 0, uint8(READ), 1, 1, 2}, OutOfBounds)
+}
+
+// Every branch goes to an instruction, an unaligned target could otherwise
+// execute the last bytes of the RAM as an instruction.
+func TestJumpOutsideOfTheCode(t *testing.T) {
+	var programs = [][]uint8{
+		{uint8(JMPB), 2, 0, 0},
+		{uint8(JMPB), 0xFC, 0, 0},
+		{uint8(JMPW), 0xFF, 0x7F, 0},
+		{uint8(JMPT), 0, 0, 0x80},
+		{uint8(CALLB), 2, 0, 0},
+		{uint8(CALLW), 0xFF, 0x7F, 0},
+		{uint8(CALLT), 0, 0, 0x80},
+		{uint8(JMPB), 5, 0, 0, uint8(HLT), 0, 0, 0},
+	}
+	for _, program := range programs {
+		expectFault(t, 64, program, OutOfBounds)
+	}
+}
+
+// expectFault runs program on a machine with ramSize bytes of RAM and checks
+// that it stops with a fault of the given kind.
+func expectFault(t *testing.T, ramSize uint32, program []uint8, kind FaultKind) {
+	t.Helper()
+	var m *Machine = NewMachine(ramSize)
+	m.CodeSize = uint32(len(program))
+	m.Load(0, program)
+	var fault *Fault
+	if err := m.executeProgram(); !errors.As(err, &fault) || fault.Kind != kind {
+		t.Errorf("executeProgram(%v) = %v, want a %s fault", program, err, kind)
+	}
+}
+
+// run assembles source and executes it on a machine with the default RAM.
+func run(t *testing.T, source string) (*Machine, error) {
+	t.Helper()
+	_, program := assemble(t, source)
+	var m *Machine = NewMachine(defaultRAMSize)
+	if err := m.LoadFile(program); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	return m, m.executeProgram()
+}
+
+// expectRegisters runs source and checks the registers of want, written as
+// signed values, once it reaches HLT.
+func expectRegisters(t *testing.T, source string, want map[int]int64) {
+	t.Helper()
+	m, err := run(t, source)
+	if err != nil {
+		t.Fatalf("executing %q failed: %v", source, err)
+	}
+	for register, value := range want {
+		if int64(m.Registers[register]) != value {
+			t.Errorf("R%d = %d, want %d", register, int64(m.Registers[register]), value)
+		}
+	}
+}
+
+// expectRunFault runs source and checks that it stops with a fault of the
+// given kind.
+func expectRunFault(t *testing.T, source string, kind FaultKind) {
+	t.Helper()
+	_, err := run(t, source)
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Kind != kind {
+		t.Errorf("executing %q gave %v, want a %s fault", source, err, kind)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -13,76 +15,226 @@ import (
 //////////////
 
 func runCommand(args []string) {
-	var program string = readFile(args[0])
+	if len(args) == 0 {
+		log.Fatal("--run needs a .vasm file.")
+	}
+	var path string = args[0]
+	var program string = readFile(path)
 	args = args[1:]
 	var debug bool = false
 	var time_measurement uint64 = 1
+	var ramSize uint32 = defaultRAMSize
+	var options assemblerOptions = newAssemblerOptions()
 
 	for i := 0; i < len(args); i++ {
-		if args[i] == "debug" {
+		if next, ok := options.parse(args, i); ok {
+			i = next
+		} else if args[i] == "-debug" {
 			debug = true
 		} else if args[i] == "-time" {
-			if !isInt(args[i+1]) {
-				log.Fatal("-time needs a integer.")
-			} else if args[i+1][0] == '-' {
-				log.Fatal("-time needs a positive integer.")
-			}
-			time_measurement = uint64(strToInt(args[i+1]))
+			time_measurement = positiveIntArg(args, i)
+			i += 1
+		} else if args[i] == "-ram" {
+			ramSize = ramSizeArg(args, i)
 			i += 1
 		} else {
 			log.Fatal("Unrecognized argument for run command : " + args[i])
 		}
 	}
 
-	var assemblerProgram [][]string = readProgram(program)
-
 	var startTime time.Time = time.Now()
-	var byteProgram []uint8 = programCleaner(assemblerProgram)
+	var file bytecodeFile = assembleFile(path, program, options)
 	var elapsed time.Duration = time.Since(startTime)
 	if debug {
-		fmt.Println(byteProgram)
+		printSections(file)
 		fmt.Printf("Time : %s\n\n", elapsed)
 	}
+
+	var machine *Machine
 	if time_measurement == 1 {
+		machine = loadMachine(file, ramSize)
 		startTime = time.Now()
-		executeProgram()
+		err := machine.executeProgram()
 		elapsed = time.Since(startTime)
+		reportFault(err)
+		machine.printState()
 		if debug {
 			fmt.Printf("Time : %s\n", elapsed)
 		}
 	} else {
 		var total_time time.Duration
 		for i := 0; uint64(i) < time_measurement; i++ {
+			machine = loadMachine(file, ramSize)
 			startTime = time.Now()
-			for i := 0; i < 1; i++ {
-				executeProgram()
-			}
+			err := machine.executeProgram()
 			total_time += time.Since(startTime)
+			reportFault(err)
 		}
-		fmt.Printf("Time : %s\n", total_time/200)
+		machine.printState()
+		fmt.Printf("Time : %s\n", total_time/time.Duration(time_measurement))
 		fmt.Printf("Total time : %s\n", total_time)
 	}
 }
 
 func checkCommand(args []string) {
-	if len(args) > 2 {
-		log.Fatal("Too many argument for --check.")
-	} else if args[0][len(args[0])-5:] != ".vasm" {
+	if len(args) == 0 {
+		log.Fatal("--check needs a .vasm file.")
+	} else if !hasExtension(args[0], ".vasm") {
 		log.Fatal("Unrecognized extension for \"" + args[0] + "\", need .vasm")
 	}
+	var debug bool = false
+	var jsonOutput bool = false
+	var expand bool = false
+	var options assemblerOptions = newAssemblerOptions()
+	for i := 1; i < len(args); i++ {
+		if next, ok := options.parse(args, i); ok {
+			i = next
+		} else if args[i] == "-debug" {
+			debug = true
+		} else if args[i] == "-json" {
+			jsonOutput = true
+		} else if args[i] == "-E" {
+			expand = true
+		} else {
+			log.Fatal("Unrecognized argument for check command : " + args[i])
+		}
+	}
 
 	var program string = readFile(args[0])
-	var assemblerProgram [][]string = readProgram(program)
+	if expand {
+		var assembler *Assembler = options.newAssembler()
+		expanded, err := assembler.Expand(args[0], program)
+		for _, diagnostic := range assembler.Diagnostics {
+			fmt.Fprintln(os.Stderr, diagnostic)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Print(expanded)
+		return
+	}
+	if jsonOutput {
+		var assembler *Assembler = options.newAssembler()
+		_, err := assembler.Assemble(args[0], program)
+		var diagnostics []Diagnostic = assembler.Diagnostics
+		if diagnostics == nil {
+			diagnostics = []Diagnostic{}
+		}
+		encoded, _ := json.MarshalIndent(diagnostics, "", "  ")
+		fmt.Println(string(encoded))
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
 
 	var startTime time.Time = time.Now()
-	var byteProgram []uint8 = programCleaner(assemblerProgram)
+	var file bytecodeFile = assembleFile(args[0], program, options)
 	var elapsed time.Duration = time.Since(startTime)
-	if len(args) > 1 && args[1] == "-debug" {
-		fmt.Println(byteProgram)
+	if debug {
+		printSections(file)
 		fmt.Printf("Time : %s\n\n", elapsed)
 	}
 }
 
+func emitCommand(args []string) {
+	if len(args) < 2 {
+		log.Fatal("--emit needs a .vasm file and an output .vbc file.")
+	} else if !hasExtension(args[0], ".vasm") {
+		log.Fatal("Unrecognized extension for \"" + args[0] + "\", need .vasm")
+	} else if !hasExtension(args[1], ".vbc") {
+		log.Fatal("Unrecognized extension for \"" + args[1] + "\", need .vbc")
+	}
+	var options assemblerOptions = newAssemblerOptions()
+	for i := 2; i < len(args); i++ {
+		if next, ok := options.parse(args, i); ok {
+			i = next
+		} else {
+			log.Fatal("Unrecognized argument for emit command : " + args[i])
+		}
+	}
+
+	var program string = readFile(args[0])
+	var file bytecodeFile = assembleFile(args[0], program, options)
+
+	err := writeBytecodeFile(args[1], file)
+	if err != nil {
+		log.Fatal("Couldn't write file : " + args[1])
+	}
+}
+
+func symbolsCommand(args []string) {
+	if len(args) < 2 {
+		log.Fatal("--symbols needs a .vasm file and an output .map file.")
+	} else if !hasExtension(args[0], ".vasm") {
+		log.Fatal("Unrecognized extension for \"" + args[0] + "\", need .vasm")
+	} else if !hasExtension(args[1], ".map") {
+		log.Fatal("Unrecognized extension for \"" + args[1] + "\", need .map")
+	}
+	var options assemblerOptions = newAssemblerOptions()
+	for i := 2; i < len(args); i++ {
+		if next, ok := options.parse(args, i); ok {
+			i = next
+		} else {
+			log.Fatal("Unrecognized argument for symbols command : " + args[i])
+		}
+	}
+
+	var assembler *Assembler = options.newAssembler()
+	_, err := assembler.Assemble(args[0], readFile(args[0]))
+	for _, diagnostic := range assembler.Diagnostics {
+		fmt.Fprintln(os.Stderr, diagnostic)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compile")
+		os.Exit(1)
+	}
+	err = os.WriteFile(args[1], []uint8(assembler.Symbols.MapFile()), 0644)
+	if err != nil {
+		log.Fatal("Couldn't write file : " + args[1])
+	}
+}
+
+func loadCommand(args []string) {
+	if len(args) < 2 {
+		log.Fatal("--load needs a .vbc file and either -c-vm or -go-vm.")
+	} else if !hasExtension(args[0], ".vbc") {
+		log.Fatal("Unrecognized extension for \"" + args[0] + "\", need .vbc")
+	}
+	var vm string = ""
+	var ramSize uint32 = defaultRAMSize
+	for i := 1; i < len(args); i++ {
+		if args[i] == "-go-vm" || args[i] == "-c-vm" {
+			vm = args[i]
+		} else if args[i] == "-ram" {
+			ramSize = ramSizeArg(args, i)
+			i += 1
+		} else {
+			log.Fatal("Unrecognized argument for load command : " + args[i])
+		}
+	}
+
+	file, err := readBytecodeFile(args[0])
+	if err != nil {
+		log.Fatal("Couldn't load \"" + args[0] + "\" : " + err.Error())
+	}
+	err = file.checkFitsInRAM(ramSize)
+	if err != nil {
+		log.Fatal("Couldn't load \"" + args[0] + "\" : " + err.Error())
+	}
+
+	switch vm {
+	case "-go-vm":
+		var machine *Machine = loadMachine(file, ramSize)
+		reportFault(machine.executeProgram())
+		machine.printState()
+	case "-c-vm":
+		log.Fatal("The C implementation of the virtual machine cannot load .vbc files yet, use -go-vm.")
+	default:
+		log.Fatal("--load needs either -c-vm or -go-vm.")
+	}
+}
+
 func helpCommand(args []string) {
 	if len(args) > 0 {
 		log.Fatal("Too many arguments for --help.")
@@ -91,39 +243,160 @@ func helpCommand(args []string) {
   --run     Assemble a .vasm file and execute it with the Go implementation of the virtual machine
   --check   Check whether a .vasm file can be assembled
   --emit    Assemble a .vasm file and save bytecode into a new file
+  --symbols Assemble a .vasm file and save the address of its labels into a map file
   --load    Load and execute an assembled bytecode file
 
 Options:
   -debug        Enable debug output (only for --run and --check)
+  -strict       Report unexpected characters instead of ignoring them (--run, --check, --emit and --symbols)
+  -json         Print the diagnostics as JSON (--check only)
+  -I <dir>      Also look for the files of .include and .incbin in <dir>, can be repeated (--run, --check, --emit and --symbols)
+  -D <name=val> Define the constant <name> as with .equ, <val> is 1 by default, can be repeated (--run, --check, --emit and --symbols)
+  -E            Print the source with its macros, .rept and .irp expanded instead of checking it (--check only)
   -time <n>     Measure average execution time over <n> runs (--run only)
+  -ram <n>      Size of the RAM of the virtual machine in bytes, 1024 by default (--run and --load -go-vm only)
   -c-vm         Execute the file with the C implementation of the virtual machine (--load only)
   -go-vm        Execute the file with the Go implementation of the virtual machine (--load only)
 
 Command usage:
-  vasm --run   <file.vasm> [-time <n>] [-debug]
-  vasm --check <file.vasm> [-debug]
-  vasm --emit  <file.vasm> <output.vbc>
-  vasm --load  <file.vbc> [-c-vm/-go-vm]`)
+  vasm --run   <file.vasm> [-time <n>] [-ram <n>] [-debug] [-strict] [-I <dir>] [-D <name=val>]
+  vasm --check <file.vasm> [-debug] [-strict] [-json] [-E] [-I <dir>] [-D <name=val>]
+  vasm --emit  <file.vasm> <output.vbc> [-strict] [-I <dir>] [-D <name=val>]
+  vasm --symbols <file.vasm> <output.map> [-strict] [-I <dir>] [-D <name=val>]
+  vasm --load  <file.vbc> [-c-vm/-go-vm] [-ram <n>]`)
 }
 
 ////////////////////
 // COMMAND HELPER //
 ////////////////////
 
-func writeToRAM(byteProgram []uint8) {
-	for i, byte := range byteProgram {
-		RAM[i] = byte
+// reportFault prints the report of a runtime fault and exits with a non-zero
+// code, it does nothing if err is nil.
+func reportFault(err error) {
+	if err == nil {
+		return
+	}
+	var fault *Fault
+	if errors.As(err, &fault) {
+		fmt.Fprint(os.Stderr, fault.Report())
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(1)
+}
+
+// assemblerOptions are the options shared by the commands that assemble a
+// .vasm file : -strict, -I and -D.
+type assemblerOptions struct {
+	strict       bool
+	includePaths []string
+	defines      map[string]string
+}
+
+func newAssemblerOptions() assemblerOptions {
+	return assemblerOptions{defines: make(map[string]string)}
+}
+
+// parse reads args[i] if it is an assembler option, and gives the index of
+// the last argument it used.
+func (options *assemblerOptions) parse(args []string, i int) (int, bool) {
+	if args[i] == "-strict" {
+		options.strict = true
+		return i, true
+	} else if args[i] == "-I" {
+		options.includePaths = append(options.includePaths, directoryArg(args, i))
+		return i + 1, true
+	} else if args[i] == "-D" {
+		name, value := defineArg(args, i)
+		options.defines[name] = value
+		return i + 1, true
+	}
+	return i, false
+}
+
+// newAssembler creates an assembler configured with the options.
+func (options assemblerOptions) newAssembler() *Assembler {
+	var assembler *Assembler = NewAssembler(options.strict)
+	assembler.IncludePaths = options.includePaths
+	assembler.Defines = options.defines
+	return assembler
+}
+
+func positiveIntArg(args []string, i int) uint64 {
+	if i+1 >= len(args) || !isInt(args[i+1]) {
+		log.Fatal(args[i] + " needs a integer.")
+	} else if args[i+1][0] == '-' || strToInt(args[i+1]) == 0 {
+		log.Fatal(args[i] + " needs a positive integer.")
+	}
+	return uint64(strToInt(args[i+1]))
+}
+
+func directoryArg(args []string, i int) string {
+	if i+1 >= len(args) {
+		log.Fatal(args[i] + " needs a directory.")
+	}
+	return args[i+1]
+}
+
+// defineArg reads the NAME=value following -D, value being 1 by default.
+func defineArg(args []string, i int) (string, string) {
+	if i+1 >= len(args) {
+		log.Fatal(args[i] + " needs a NAME=value.")
+	}
+	name, value, found := strings.Cut(args[i+1], "=")
+	if !found {
+		value = "1"
+	}
+	if !isIdentifier(name) || inList(forbiddenLabels, name) {
+		log.Fatal("Forbidden constant name for " + args[i] + " : " + name)
+	} else if value == "" {
+		log.Fatal(args[i] + " " + name + "= needs a value.")
+	}
+	return name, value
+}
+
+func ramSizeArg(args []string, i int) uint32 {
+	var size uint64 = positiveIntArg(args, i)
+	if size < 64 || size > 1<<32-1 || size%4 != 0 {
+		log.Fatal("-ram needs a multiple of 4 between 64 and 4294967292.")
+	}
+	return uint32(size)
+}
+
+// assembleFile assembles the program read from path, prints the diagnostics
+// and exits with a non-zero code if the program has errors.
+func assembleFile(path string, program string, options assemblerOptions) bytecodeFile {
+	var assembler *Assembler = options.newAssembler()
+	file, err := assembler.Assemble(path, program)
+	for _, diagnostic := range assembler.Diagnostics {
+		fmt.Fprintln(os.Stderr, diagnostic)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compile")
+		os.Exit(1)
+	}
+	fmt.Println("No compile error")
+	return file
+}
+
+// loadMachine creates a machine with ramSize bytes of RAM and loads file in
+// it, or exits if file does not fit.
+func loadMachine(file bytecodeFile, ramSize uint32) *Machine {
+	var machine *Machine = NewMachine(ramSize)
+	err := machine.LoadFile(file)
+	if err != nil {
+		log.Fatal("Couldn't load the program : " + err.Error())
 	}
+	return machine
 }
 
-func readProgram(program string) [][]string {
-	var operations []string = strings.Split(program, "\n")
-	var assemblerProgram [][]string
+var sectionKindNames = map[uint8]string{sectionCode: ".text", sectionData: ".data", sectionBss: ".bss"}
 
-	for _, line := range operations {
-		assemblerProgram = append(assemblerProgram, strings.Fields(line))
+func printSections(file bytecodeFile) {
+	for _, sec := range file.Sections {
+		fmt.Println(sectionKindNames[sec.Kind] + " at address " + intToStr(int(sec.Address)) + " :")
+		fmt.Println(sec.Content)
 	}
-	return assemblerProgram
 }
 
 func readFile(path string) string {
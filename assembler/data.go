@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+)
+
+/////////////////////
+// DATA DIRECTIVES //
+/////////////////////
+
+var dataDirectives []string = []string{".byte", ".word", ".dword", ".qword", ".ascii", ".asciz", ".zero", ".align", ".addr"}
+
+// Size in bytes and kind of one value of the directives taking a list of values.
+var dataValueSizes map[string]int = map[string]int{".byte": 1, ".word": 2, ".dword": 4, ".qword": 8, ".addr": 8}
+var dataValueKinds map[string]string = map[string]string{".byte": "Int8", ".word": "Int16", ".dword": "Int32", ".qword": "Int64"}
+
+// .zero cannot reserve more than this, the RAM of the VM is much smaller anyway.
+const maxZeroSize int64 = 1 << 24
+
+// directiveSize gives the number of bytes the directive line takes when it
+// starts at address, and the alignment it needs (1 except for .align). The
+// values of .byte to .qword are only evaluated by directiveBytes, once every
+// label is known, but the size of .zero and .align is needed right away, so
+// their operand can only use constants.
+func (a *Assembler) directiveSize(line []Token, address int) (int, int) {
+	var directive string = line[0].Text
+	var operands []Token = line[1:]
+	switch directive {
+	case ".byte", ".word", ".dword", ".qword", ".addr":
+		if len(operands) == 0 {
+			a.errorAt(line[0], codeWrongNumberOfArgs, "\""+directive+"\" needs at least one value")
+		}
+		return len(operands) * dataValueSizes[directive], 1
+	case ".ascii", ".asciz":
+		if len(operands) == 0 {
+			a.errorAt(line[0], codeWrongNumberOfArgs, "\""+directive+"\" needs at least one string")
+		}
+		var size int = 0
+		for _, operand := range operands {
+			text, err := stringLiteral(operand.Text)
+			if err != nil {
+				a.errorAt(operand, codeSyntaxError, err.Error())
+			}
+			size += len(text)
+			if directive == ".asciz" {
+				size += 1
+			}
+		}
+		return size, 1
+	case ".zero", ".align":
+		if len(operands) != 1 {
+			a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \""+directive+"\", expected 1 but got "+intToStr(len(operands)))
+			return 0, 1
+		}
+		value, ok := a.evaluate(operands[0])
+		if !ok {
+			return 0, 1
+		}
+		if directive == ".zero" {
+			if value < 0 || value > maxZeroSize {
+				a.errorAt(operands[0], codeImmediateTooBig, "the size of \".zero\" must be between 0 and "+formatValue(maxZeroSize))
+				return 0, 1
+			}
+			return int(value), 1
+		}
+		if value <= 0 || value > maxZeroSize || (value != 1 && !isPowerOfTwo(int(value))) {
+			a.errorAt(operands[0], codeImmediateTooBig, "the alignment of \".align\" must be a power of two")
+			return 0, 1
+		}
+		return (int(value) - address%int(value)) % int(value), int(value)
+	}
+	return 0, 1
+}
+
+// directiveBytes gives the content of a data directive. The padding of .zero
+// and .align is added by programCleaner from the addresses of the lines.
+func (a *Assembler) directiveBytes(line []Token) []uint8 {
+	var directive string = line[0].Text
+	var content []uint8
+	switch directive {
+	case ".byte", ".word", ".dword", ".qword":
+		var kind string = dataValueKinds[directive]
+		for _, operand := range line[1:] {
+			value, ok := a.evaluate(operand)
+			if ok && !fitsIn(value, kind) {
+				low, high := rangeOf(kind)
+				a.errorAt(operand, codeImmediateTooBig, "value \""+operand.Text+"\" does not fit in a \""+directive+"\", it must be between "+formatValue(low)+" and "+formatValue(high))
+			}
+			for i := 0; i < dataValueSizes[directive]; i++ {
+				content = append(content, uint8(uint64(value)>>(8*i)))
+			}
+		}
+	case ".addr":
+		// an address on 64 bits, so READ @64 then JMPR or CALLR can use it
+		for _, operand := range line[1:] {
+			value, ok := a.evaluate(operand)
+			if ok && (value < 0 || value > 1<<32-1) {
+				a.errorAt(operand, codeImmediateTooBig, "\""+operand.Text+"\" is not an address, it must be between 0 and "+formatValue(1<<32-1))
+			}
+			for i := 0; i < dataValueSizes[directive]; i++ {
+				content = append(content, uint8(uint64(value)>>(8*i)))
+			}
+		}
+	case ".ascii", ".asciz":
+		for _, operand := range line[1:] {
+			// the errors were already reported by directiveSize
+			text, _ := stringLiteral(operand.Text)
+			content = append(content, text...)
+			if directive == ".asciz" {
+				content = append(content, 0)
+			}
+		}
+	}
+	return content
+}
+
+// stringLiteral reads a string between double quotes, with the same escapes
+// as the character literals.
+func stringLiteral(word string) ([]uint8, error) {
+	if len(word) < 2 || word[0] != '"' || word[len(word)-1] != '"' {
+		return nil, errors.New("expected a string between double quotes, got " + word)
+	}
+	return unescape(word[1 : len(word)-1])
+}
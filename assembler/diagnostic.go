@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityNote    Severity = "note"
+)
+
+// Every diagnostic has a stable code so editors and CI scripts can match on
+// it, errors start with E and warnings with W.
+const (
+	codeUnexpectedCharacter = "E001"
+	codeUnterminatedQuote   = "E002"
+	codeUnterminatedComment = "E003"
+	codeWrongNumberOfArgs   = "E004"
+	codeUnrecognizedToken   = "E005"
+	codeImmediateTooBig     = "E006"
+	codeDivisionByZero      = "E007"
+	codeForbiddenLabel      = "E008"
+	codeSyntaxError         = "E009"
+	codeUndefinedLabel      = "E010"
+	codeInvalidNumber       = "E011"
+	codeInvalidExpression   = "E012"
+	codeDuplicateSymbol     = "E013"
+	codeWrongSection        = "E014"
+	codeUnterminatedBlock   = "E015"
+	codeUnexpectedDirective = "E016"
+	codeExpansionTooDeep    = "E017"
+	codeFileNotFound        = "E018"
+	codeIncludeCycle        = "E019"
+	codeUserError           = "E020"
+	codeIgnoredCharacter    = "W001"
+	codeUserWarning         = "W002"
+	codeUnusedSymbol        = "W003"
+)
+
+// Diagnostic is an error or a warning found while assembling. Line and Column
+// start at 1, Excerpt is the source line followed by a caret under Column.
+// Notes give more context, such as the macro invocations that led to it.
+type Diagnostic struct {
+	File     string       `json:"file"`
+	Line     int          `json:"line"`
+	Column   int          `json:"column"`
+	Severity Severity     `json:"severity"`
+	Code     string       `json:"code"`
+	Message  string       `json:"message"`
+	Excerpt  string       `json:"excerpt"`
+	Notes    []Diagnostic `json:"notes,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	var text string = d.File + ":" + intToStr(d.Line) + ":" + intToStr(d.Column) + ": " + string(d.Severity)
+	if d.Code != "" {
+		text += "[" + d.Code + "]"
+	}
+	text += ": " + d.Message
+	if d.Excerpt != "" {
+		text += "\n" + d.Excerpt
+	}
+	for _, note := range d.Notes {
+		text += "\n" + note.String()
+	}
+	return text
+}
+
+///////////////
+// REPORTING //
+///////////////
+
+func (a *Assembler) report(file string, severity Severity, line int, column int, code string, message string) {
+	a.Diagnostics = append(a.Diagnostics, Diagnostic{
+		File:     file,
+		Line:     line,
+		Column:   column,
+		Severity: severity,
+		Code:     code,
+		Message:  message,
+		Excerpt:  a.excerpt(file, line, column),
+	})
+}
+
+func (a *Assembler) errorAt(token Token, code string, message string) {
+	a.reportAt(token, SeverityError, code, message)
+}
+
+func (a *Assembler) warningAt(token Token, code string, message string) {
+	a.reportAt(token, SeverityWarning, code, message)
+}
+
+// reportAt reports a diagnostic at token, with a note for every macro, .rept,
+// .irp or .include that expanded it. A macro expanding itself only gets one
+// note.
+func (a *Assembler) reportAt(token Token, severity Severity, code string, message string) {
+	a.report(token.File, severity, token.Line, token.Column, code, message)
+	var diagnostic *Diagnostic = &a.Diagnostics[len(a.Diagnostics)-1]
+	for invocation := token.Invocation; invocation != nil; invocation = invocation.Invocation {
+		var notes []Diagnostic = diagnostic.Notes
+		if len(notes) != 0 && notes[len(notes)-1].File == invocation.File && notes[len(notes)-1].Line == invocation.Line && notes[len(notes)-1].Column == invocation.Column {
+			continue
+		}
+		var message string = "in the expansion of \"" + invocation.Text + "\""
+		if invocation.Text == ".include" {
+			message = "included from here"
+		}
+		a.noteAt(*invocation, message)
+	}
+}
+
+// noteAt adds a note at token to the last reported diagnostic.
+func (a *Assembler) noteAt(token Token, message string) {
+	var diagnostic *Diagnostic = &a.Diagnostics[len(a.Diagnostics)-1]
+	diagnostic.Notes = append(diagnostic.Notes, Diagnostic{
+		File:     token.File,
+		Line:     token.Line,
+		Column:   token.Column,
+		Severity: SeverityNote,
+		Message:  message,
+		Excerpt:  a.excerpt(token.File, token.Line, token.Column),
+	})
+}
+
+func (a *Assembler) hasErrors() bool {
+	for _, diagnostic := range a.Diagnostics {
+		if diagnostic.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// excerpt gives the source line with a caret under column. Tabs before the
+// column are kept in the caret line so the caret stays aligned.
+func (a *Assembler) excerpt(file string, line int, column int) string {
+	var lines []string = a.sources[file]
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	var source string = strings.TrimRight(lines[line-1], "\r")
+	var caret strings.Builder
+	for i, char := range []rune(source) {
+		if i >= column-1 {
+			break
+		}
+		if char == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	var prefix string = "  " + intToStr(line) + " | "
+	return prefix + source + "\n" + strings.Repeat(" ", len(prefix)-2) + "| " + caret.String() + "^"
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+/////////////////
+// EXPRESSIONS //
+/////////////////
+
+// Operators from the lowest to the highest precedence, like in C. Every
+// operator is left-associative, and the unary -, +, ~ and ! bind tighter than
+// all of them. Comparisons and logical operators give 1 or 0.
+var binaryOperators [][]string = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type expressionParser struct {
+	a       *Assembler
+	token   Token
+	text    string
+	pos     int
+	err     string
+	errCode string
+}
+
+func (p *expressionParser) fail(code string, message string) {
+	if p.err == "" {
+		p.err, p.errCode = message, code
+	}
+}
+
+// evaluate computes the value of the expression held by token. Symbols are
+// either .equ constants or labels, which are the byte address of the label.
+// Errors are reported at the position of token and make evaluate return false.
+func (a *Assembler) evaluate(token Token) (int64, bool) {
+	var parser expressionParser = expressionParser{a: a, token: token, text: token.Text}
+	var value int64 = parser.parseBinary(0)
+	parser.skipSpaces()
+	if parser.err == "" && parser.pos < len(parser.text) {
+		parser.fail(codeInvalidExpression, "unexpected \""+parser.text[parser.pos:]+"\"")
+	}
+	if parser.err != "" {
+		a.errorAt(token, parser.errCode, parser.err)
+		return 0, false
+	}
+	return value, true
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos += 1
+	}
+}
+
+func (p *expressionParser) parseBinary(level int) int64 {
+	if level == len(binaryOperators) {
+		return p.parseUnary()
+	}
+	var left int64 = p.parseBinary(level + 1)
+	for p.err == "" {
+		p.skipSpaces()
+		var operator string = operatorAt(p.text[p.pos:])
+		if !inList(binaryOperators[level], operator) {
+			return left
+		}
+		p.pos += len(operator)
+		var right int64 = p.parseBinary(level + 1)
+		if p.err != "" {
+			return 0
+		}
+		switch operator {
+		case "||":
+			left = boolToInt(left != 0 || right != 0)
+		case "&&":
+			left = boolToInt(left != 0 && right != 0)
+		case "==":
+			left = boolToInt(left == right)
+		case "!=":
+			left = boolToInt(left != right)
+		case "<":
+			left = boolToInt(left < right)
+		case "<=":
+			left = boolToInt(left <= right)
+		case ">":
+			left = boolToInt(left > right)
+		case ">=":
+			left = boolToInt(left >= right)
+		case "|":
+			left |= right
+		case "^":
+			left ^= right
+		case "&":
+			left &= right
+		case "<<":
+			left = int64(uint64(left) << uint64(right))
+		case ">>":
+			left = int64(uint64(left) >> uint64(right))
+		case "+":
+			left += right
+		case "-":
+			left -= right
+		case "*":
+			left *= right
+		case "/", "%":
+			if right == 0 {
+				p.fail(codeDivisionByZero, "division by zero in the expression")
+				return 0
+			}
+			if operator == "/" {
+				left /= right
+			} else {
+				left %= right
+			}
+		}
+	}
+	return 0
+}
+
+func (p *expressionParser) parseUnary() int64 {
+	p.skipSpaces()
+	if p.pos >= len(p.text) {
+		p.fail(codeInvalidExpression, "missing value at the end of the expression")
+		return 0
+	}
+	switch p.text[p.pos] {
+	case '-':
+		p.pos += 1
+		return -p.parseUnary()
+	case '+':
+		p.pos += 1
+		return p.parseUnary()
+	case '~':
+		p.pos += 1
+		return ^p.parseUnary()
+	case '!':
+		p.pos += 1
+		return boolToInt(p.parseUnary() == 0)
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() int64 {
+	var start int = p.pos
+	var char uint8 = p.text[p.pos]
+	switch {
+	case char == '(':
+		p.pos += 1
+		var value int64 = p.parseBinary(0)
+		p.skipSpaces()
+		if p.pos >= len(p.text) || p.text[p.pos] != ')' {
+			p.fail(codeInvalidExpression, "missing closing parenthesis")
+			return value
+		}
+		p.pos += 1
+		return value
+	case char == '\'':
+		var size int = quotedLength(p.text[p.pos:])
+		if size == -1 {
+			p.fail(codeInvalidNumber, "missing closing '")
+			return 0
+		}
+		p.pos += size
+		value, err := parseNumber(p.text[start:p.pos])
+		if err != nil {
+			p.fail(codeInvalidNumber, err.Error())
+		}
+		return value
+	case isDigit(char):
+		for p.pos < len(p.text) && isIdentifierCharacter(p.text[p.pos]) {
+			p.pos += 1
+		}
+		value, err := parseNumber(p.text[start:p.pos])
+		if err != nil {
+			p.fail(codeInvalidNumber, err.Error())
+		}
+		return value
+	case isIdentifierCharacter(char):
+		for p.pos < len(p.text) && isIdentifierCharacter(p.text[p.pos]) {
+			p.pos += 1
+		}
+		return p.symbol(p.text[start:p.pos])
+	}
+	p.fail(codeInvalidExpression, "unexpected \""+string(char)+"\"")
+	return 0
+}
+
+func (p *expressionParser) symbol(name string) int64 {
+	if _, ok := p.a.constants[name]; ok {
+		value, err := p.a.constantValue(name)
+		if err != "" {
+			p.fail(codeInvalidExpression, err)
+		}
+		return value
+	}
+	// The pseudo-instructions copy an expression into several instructions,
+	// and only put parentheses before it, so the source position of the token
+	// and the number of times name was seen in it identify the use.
+	var use string = p.token.File + ":" + intToStr(p.token.Line) + ":" + intToStr(p.token.Column) + ":" + intToStr(strings.Count(p.text[:p.pos], name))
+	if address, ok := p.a.Symbols.reference(name, use); ok {
+		return int64(address)
+	}
+	p.fail(codeUndefinedLabel, "undefined symbol \""+name+"\"")
+	return 0
+}
+
+// operatorAt gives the longest binary operator at the start of text, so that
+// "<<" is never read as "<" and "||" as "|".
+func operatorAt(text string) string {
+	var operator string = ""
+	for _, level := range binaryOperators {
+		for _, candidate := range level {
+			if strings.HasPrefix(text, candidate) && len(candidate) > len(operator) {
+				operator = candidate
+			}
+		}
+	}
+	return operator
+}
+
+///////////////
+// CONSTANTS //
+///////////////
+
+// defineConstant handles ".equ NAME expression". The expression is only
+// evaluated when the constant is used, so it can refer to labels defined
+// later in the program.
+func (a *Assembler) defineConstant(line []Token) {
+	if len(line) != 3 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "\".equ\" needs a name and a value")
+		return
+	}
+	var name string = line[1].Text
+	if !isIdentifier(name) || inList(forbiddenLabels, name) {
+		a.errorAt(line[1], codeForbiddenLabel, "forbidden constant name \""+name+"\"")
+	} else if _, ok := a.constants[name]; ok {
+		a.errorAt(line[1], codeDuplicateSymbol, "constant \""+name+"\" is already defined")
+	} else {
+		a.constants[name] = line[2]
+	}
+}
+
+const (
+	constantResolving int = iota + 1
+	constantFailed
+)
+
+// constantValue evaluates the constant name once and keeps its value. It
+// returns an error message for a constant that depends on itself or has an
+// invalid value, the error of the value itself is only reported once, where
+// the constant is defined.
+func (a *Assembler) constantValue(name string) (int64, string) {
+	if value, ok := a.constantValues[name]; ok {
+		return value, ""
+	}
+	switch a.constantStates[name] {
+	case constantResolving:
+		return 0, "constant \"" + name + "\" depends on itself"
+	case constantFailed:
+		return 0, "invalid value for constant \"" + name + "\""
+	}
+	a.constantStates[name] = constantResolving
+	value, ok := a.evaluate(a.constants[name])
+	if !ok {
+		a.constantStates[name] = constantFailed
+		return 0, "invalid value for constant \"" + name + "\""
+	}
+	delete(a.constantStates, name)
+	a.constantValues[name] = value
+	return value, ""
+}
+
+///////////
+// UTILS //
+///////////
+
+func isDigit(char uint8) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isIdentifierCharacter(char uint8) bool {
+	return isDigit(char) || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char == '_' || char == '.'
+}
+
+func isIdentifier(word string) bool {
+	if word == "" || isDigit(word[0]) {
+		return false
+	}
+	for i := range len(word) {
+		if !isIdentifierCharacter(word[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func boolToInt(condition bool) int64 {
+	if condition {
+		return 1
+	}
+	return 0
+}
+
+func formatValue(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	var tests = []struct {
+		text  string
+		value int64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"1 << 2 | 1", 5},
+		{"-8 / 3", -2},
+		{"0x10 - 'A'", -49},
+		{"2 < 3 && 3 != 4", 1},
+		{"!0 + ~0", 0},
+	}
+	for _, test := range tests {
+		var a *Assembler = NewAssembler(false)
+		a.read("test.vasm", "")
+		value, ok := a.evaluate(Token{Text: test.text, File: "test.vasm", Line: 1, Column: 1})
+		if !ok || value != test.value {
+			t.Errorf("evaluate(%q) = %d, %v, want %d", test.text, value, ok, test.value)
+		}
+	}
+}
+
+// A typo in an expression must give a diagnostic, not a panic.
+func TestInvalidExpressions(t *testing.T) {
+	var sources = []string{
+		"ADDIB R1, (1+2\nHLT\n",
+		".equ X (1+2\nADDIB R1, X\nHLT\n",
+		"LI R1, (\nHLT\n",
+		"t: .addr t\nSWITCH R1, t, (\nHLT\n",
+		"ADDIB R1, (\nHLT\n",
+		"ADDIB R1, 1+\nHLT\n",
+		"ADDIB R1, (1))\nHLT\n",
+	}
+	for _, source := range sources {
+		expectError(t, source, codeInvalidExpression)
+	}
+}
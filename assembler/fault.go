@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type FaultKind int
+
+const (
+	StackOverflow FaultKind = iota + 1
+	StackUnderflow
+	OutOfBounds
+	WriteToCode
+	IllegalOpcode
+	IllegalOperand
+	DivideByZero
+)
+
+var faultKindNames = map[FaultKind]string{
+	StackOverflow:  "StackOverflow",
+	StackUnderflow: "StackUnderflow",
+	OutOfBounds:    "OutOfBounds",
+	WriteToCode:    "WriteToCode",
+	IllegalOpcode:  "IllegalOpcode",
+	IllegalOperand: "IllegalOperand",
+	DivideByZero:   "DivideByZero",
+}
+
+func (kind FaultKind) String() string {
+	name, ok := faultKindNames[kind]
+	if !ok {
+		return "UnknownFault"
+	}
+	return name
+}
+
+// Fault is returned by executeProgram when the program does something the
+// machine cannot execute. It holds the state of the machine at the faulting
+// instruction so the caller can report it or recover.
+type Fault struct {
+	Kind      FaultKind
+	PC        uint32
+	Opcode    uint8
+	Registers [16]uint64
+	Message   string
+}
+
+func (m *Machine) fault(kind FaultKind, pc uint32, message string) *Fault {
+	var opcode uint8
+	if pc < m.RAMSize {
+		opcode = m.RAM[pc]
+	}
+	m.PC = pc
+	return &Fault{Kind: kind, PC: pc, Opcode: opcode, Registers: m.Registers, Message: message}
+}
+
+func (f *Fault) Error() string {
+	return f.Kind.String() + " at address " + intToStr(int(f.PC)) + " : " + f.Message
+}
+
+// Report gives a human readable description of the fault, with the faulting
+// instruction and a dump of the registers.
+func (f *Fault) Report() string {
+	var report strings.Builder
+	var mnemonic string = "unknown opcode"
+	if name, ok := opcodeToMnemonics[int(f.Opcode)]; ok {
+		mnemonic = name
+	}
+	report.WriteString("Runtime fault : " + f.Kind.String() + "\n")
+	report.WriteString("  at address " + intToStr(int(f.PC)) + " (opcode " + intToStr(int(f.Opcode)) + ", " + mnemonic + ")\n")
+	report.WriteString("  " + f.Message + "\n")
+	report.WriteString("Registers :\n")
+	for i, value := range f.Registers {
+		report.WriteString(fmt.Sprintf("  R%-2d = 0x%016X (%d)\n", i, value, int64(value)))
+	}
+	return report.String()
+}
@@ -1,3 +1,3 @@
-module main
+module assembler
 
 go 1.25.4
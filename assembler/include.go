@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//////////////
+// INCLUDES //
+//////////////
+
+// include handles `.include "file"`, which is replaced by the content of
+// file. The tokens of file remember the .include line, so the diagnostics
+// inside file can show where it was included from.
+func (a *Assembler) include(line []Token, depth int) [][]Token {
+	if len(line) != 2 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \".include\", expected 1 but got "+intToStr(len(line)-1))
+		return nil
+	}
+	path, content, ok := a.findFile(line[1])
+	if !ok {
+		return nil
+	}
+	var key string = absolutePath(path)
+	if inList(a.includeStack, key) {
+		var cycle []string
+		for _, included := range a.includeStack[indexOf(a.includeStack, key):] {
+			cycle = append(cycle, filepath.Base(included))
+		}
+		a.errorAt(line[1], codeIncludeCycle, "include cycle : "+strings.Join(cycle, " -> ")+" -> "+filepath.Base(key))
+		return nil
+	}
+
+	var invocation Token = line[0]
+	var program [][]Token = a.tokenizeFile(path, string(content))
+	for _, included := range program {
+		for j := range included {
+			included[j].Invocation = &invocation
+		}
+	}
+	a.includeStack = append(a.includeStack, key)
+	program = a.preprocess(program, depth)
+	a.includeStack = a.includeStack[:len(a.includeStack)-1]
+	return program
+}
+
+// incbin handles `.incbin "file", offset, length`, which is replaced by a
+// .byte line holding length bytes of file from offset. The offset is 0 and
+// the length goes to the end of the file by default.
+func (a *Assembler) incbin(line []Token) [][]Token {
+	if len(line) < 2 || len(line) > 4 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \".incbin\", expected from 1 to 3 but got "+intToStr(len(line)-1))
+		return nil
+	}
+	_, content, ok := a.findFile(line[1])
+	if !ok {
+		return nil
+	}
+	var offset, length int64 = 0, int64(len(content))
+	if len(line) > 2 {
+		offset, ok = a.evaluate(line[2])
+		if !ok {
+			return nil
+		} else if offset < 0 || offset > int64(len(content)) {
+			a.errorAt(line[2], codeImmediateTooBig, "the offset must be between 0 and the size of the file ("+intToStr(len(content))+")")
+			return nil
+		}
+		length = int64(len(content)) - offset
+	}
+	if len(line) > 3 {
+		length, ok = a.evaluate(line[3])
+		if !ok {
+			return nil
+		} else if length < 0 || offset+length > int64(len(content)) {
+			a.errorAt(line[3], codeImmediateTooBig, "the length must be between 0 and "+formatValue(int64(len(content))-offset)+", the size of the file after the offset")
+			return nil
+		}
+	}
+	if length == 0 {
+		return nil
+	}
+
+	var values []Token = []Token{line[0]}
+	values[0].Text = ".byte"
+	for _, value := range content[offset : offset+length] {
+		var token Token = line[1]
+		token.Text = intToStr(int(value))
+		values = append(values, token)
+	}
+	return [][]Token{values}
+}
+
+// findFile reads the file named by the string of token. A relative name is
+// searched next to the file containing token, then in every include path.
+func (a *Assembler) findFile(token Token) (string, []uint8, bool) {
+	name, err := stringLiteral(token.Text)
+	if err != nil {
+		a.errorAt(token, codeSyntaxError, err.Error())
+		return "", nil, false
+	}
+	var candidates []string = []string{string(name)}
+	if !filepath.IsAbs(string(name)) {
+		candidates = []string{filepath.Join(filepath.Dir(token.File), string(name))}
+		for _, directory := range a.IncludePaths {
+			candidates = append(candidates, filepath.Join(directory, string(name)))
+		}
+	}
+	for _, path := range candidates {
+		content, err := os.ReadFile(path)
+		if err == nil {
+			return path, content, true
+		}
+	}
+	a.errorAt(token, codeFileNotFound, "cannot read \""+string(name)+"\", looked in "+strings.Join(candidates, ", "))
+	return "", nil, false
+}
+
+func absolutePath(path string) string {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return absolute
+}
+
+func indexOf(list []string, item string) int {
+	for i, element := range list {
+		if element == item {
+			return i
+		}
+	}
+	return -1
+}
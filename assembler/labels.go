@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+)
+
+//////////////////
+// LABEL SCOPES //
+//////////////////
+
+// A local label ".name" belongs to the last global label defined before it,
+// and is renamed "global.name" so it can be reached from anywhere with this
+// name. The global labels of a macro, .rept or .irp expansion do not change
+// the scope, as they are renamed for every expansion anyway.
+// An anonymous label is a number, "1:" can be defined many times and "1b"
+// refers to the last one defined up to the current line, "1f" to the next
+// one after it. They are renamed ".anonN.K", K counting the definitions,
+// which cannot clash with a name of the program as the names starting with a
+// dot are all renamed.
+
+type anonymousLabel struct {
+	line int
+	name string
+}
+
+// scopeLabels gives program with the local and anonymous labels, and the
+// references to them, renamed to unique names. The Kind of every label token
+// becomes its scope, "Global", "Local" or "Anonymous".
+func (a *Assembler) scopeLabels(program [][]Token) [][]Token {
+	var anonymous map[string][]anonymousLabel = make(map[string][]anonymousLabel)
+	var count int = 0
+	for i, line := range program {
+		if name := labelName(line[0]); isLabel(line[0]) && isAnonymousLabel(name) {
+			count += 1
+			anonymous[name] = append(anonymous[name], anonymousLabel{i, ".anon" + name + "." + intToStr(count)})
+		}
+	}
+
+	var scope string = ""
+	for i, line := range program {
+		var first int = 0
+		if isLabel(line[0]) {
+			var name string = labelName(line[0])
+			line[0].Kind = "Global"
+			if name == "" {
+				a.errorAt(line[0], codeForbiddenLabel, "empty label name")
+			} else if isAnonymousLabel(name) {
+				line[0].Text, line[0].Kind = anonymousTarget(anonymous[name], i, 'b')+":", "Anonymous"
+			} else if name[0] == '.' && !inList(forbiddenLabels, name) {
+				line[0].Kind = "Local"
+				if scope == "" {
+					a.errorAt(line[0], codeForbiddenLabel, "local label \""+name+"\" has no global label before it")
+				} else {
+					line[0].Text = scope + name + ":"
+				}
+			} else if line[0].Invocation == nil || line[0].Invocation.Text == ".include" {
+				scope = name
+			}
+			first = 1
+		}
+		if first == len(line) {
+			continue
+		}
+		for j := first + 1; j < len(line); j++ {
+			if line[first].Text == ".equ" && j == first+1 {
+				continue
+			}
+			line[j].Text = a.scopeSymbols(line[j], scope, i, anonymous)
+		}
+		if line[first].Text == ".equ" && len(line) == first+3 {
+			if constant, ok := a.constants[line[first+1].Text]; ok && constant.File == line[first+2].File && constant.Line == line[first+2].Line && constant.Column == line[first+2].Column {
+				a.constants[line[first+1].Text] = line[first+2]
+			}
+		}
+	}
+	return program
+}
+
+// scopeSymbols renames the local labels and the anonymous references of the
+// operand token, found on the line number line of the program.
+func (a *Assembler) scopeSymbols(token Token, scope string, line int, anonymous map[string][]anonymousLabel) string {
+	var text string = token.Text
+	var result strings.Builder
+	for i := 0; i < len(text); {
+		var end int = i + 1
+		if text[i] == '\'' || text[i] == '"' {
+			var size int = quotedLength(text[i:])
+			if size == -1 {
+				size = len(text) - i
+			}
+			end = i + size
+		} else if isIdentifierCharacter(text[i]) {
+			for end < len(text) && isIdentifierCharacter(text[end]) {
+				end += 1
+			}
+			var word string = text[i:end]
+			var direction uint8 = word[len(word)-1]
+			if word[0] == '.' && scope != "" {
+				result.WriteString(scope + word)
+				i = end
+				continue
+			} else if len(word) > 1 && (direction == 'b' || direction == 'f') && isAnonymousLabel(word[:len(word)-1]) {
+				var target string = anonymousTarget(anonymous[word[:len(word)-1]], line, direction)
+				if target == "" {
+					var where string = "before"
+					if direction == 'f' {
+						where = "after"
+					}
+					a.errorAt(token, codeUndefinedLabel, "no anonymous label \""+word[:len(word)-1]+"\" "+where+" this line")
+					target = "0"
+				}
+				result.WriteString(target)
+				i = end
+				continue
+			}
+		}
+		result.WriteString(text[i:end])
+		i = end
+	}
+	return result.String()
+}
+
+// anonymousTarget gives the name of the last definition at or before line
+// for direction 'b', or of the first one after line for 'f', and "" when
+// there is none.
+func anonymousTarget(definitions []anonymousLabel, line int, direction uint8) string {
+	var target string = ""
+	for _, definition := range definitions {
+		if direction == 'b' && definition.line <= line {
+			target = definition.name
+		} else if direction == 'f' && definition.line > line {
+			return definition.name
+		}
+	}
+	return target
+}
+
+func labelName(token Token) string {
+	return strings.TrimSuffix(token.Text, ":")
+}
+
+func isAnonymousLabel(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := range len(name) {
+		if !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEmptyLabel(t *testing.T) {
+	for _, source := range []string{":\nHLT\n", ": HLT\n"} {
+		expectError(t, source, codeForbiddenLabel)
+	}
+}
+
+func TestLocalLabels(t *testing.T) {
+	a, _ := assemble(t, "first:\n.loop: JMP .loop\nsecond:\n.loop: JMP .loop\nHLT\n")
+	for _, name := range []string{"first.loop", "second.loop"} {
+		if _, ok := a.Symbols.symbols[name]; !ok {
+			t.Errorf("symbol %q is not defined", name)
+		}
+	}
+}
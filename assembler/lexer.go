@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Token is one word of the source with its position in File, Line and Column
+// both start at 1. The lexer gives the raw Text and an empty Kind, checkWords then
+// fills Kind ("Operation", "Register", "Int8"...) and may rewrite Text. The
+// tokens copied by a macro, .rept or .irp keep the position of their
+// definition, and Invocation is the word that expanded them.
+type Token struct {
+	Text       string
+	Kind       string
+	File       string
+	Line       int
+	Column     int
+	Invocation *Token
+}
+
+const wordCharacters string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890_:-*@.()+/%&|^~<>\\=!"
+
+///////////
+// LEXER //
+///////////
+
+// tokenize splits the source into lines of tokens. Words are separated by
+// spaces or commas, and the following comments are ignored :
+//
+//	; until the end of the line
+//	// until the end of the line
+//	/* until the next */, even across several lines
+//
+// A character that cannot be part of a word is stripped from the word, or
+// reported as an error in strict mode. Text between quotes ('A' or "abc")
+// is kept as is, and so are the spaces between parentheses. When the operands
+// of a line are separated by commas, the spaces inside an operand are kept
+// too, so "ADDIB R1, 2 + 3" has two operands, see also expressionStart. Lines
+// without any token are dropped.
+func (a *Assembler) tokenize(file string, source string) [][]Token {
+	var program [][]Token
+	var line []Token
+	var word strings.Builder
+	var wordLine, wordColumn int
+	var lineNumber, column int = 1, 1
+	var inBlockComment bool = false
+	var blockCommentLine, blockCommentColumn int
+	var depth int = 0
+	var groups []int
+	var commas int = 0
+
+	endWord := func() {
+		if word.Len() != 0 {
+			line = append(line, Token{Text: word.String(), File: file, Line: wordLine, Column: wordColumn})
+			groups = append(groups, commas)
+			word.Reset()
+		}
+	}
+	addToWord := func(text string) {
+		if word.Len() == 0 {
+			wordLine, wordColumn = lineNumber, column
+		}
+		word.WriteString(text)
+	}
+	endLine := func() {
+		endWord()
+		if start := expressionStart(line); start != -1 {
+			for i := start; i < len(groups); i++ {
+				groups[i] = -1
+			}
+			line = joinOperands(line, groups)
+		} else if commas != 0 {
+			line = joinOperands(line, groups)
+		}
+		if len(line) != 0 {
+			program = append(program, line)
+			line = nil
+		}
+		depth, groups, commas = 0, nil, 0
+	}
+
+	for len(source) != 0 {
+		char, size := utf8.DecodeRuneInString(source)
+		switch {
+		case inBlockComment:
+			if char == '\n' {
+				endLine()
+			} else if strings.HasPrefix(source, "*/") {
+				inBlockComment = false
+				size = 2
+			}
+		case char == '\n':
+			endLine()
+		case (char == ' ' || char == '\t') && depth > 0:
+			addToWord(" ")
+		case char == ' ' || char == '\t' || char == '\r':
+			endWord()
+		case char == ',':
+			endWord()
+			depth = 0
+			commas += 1
+		case char == ';' || strings.HasPrefix(source, "//"):
+			endWord()
+			size = strings.IndexByte(source, '\n')
+			if size == -1 {
+				size = len(source)
+			}
+		case strings.HasPrefix(source, "/*"):
+			endWord()
+			inBlockComment = true
+			blockCommentLine, blockCommentColumn = lineNumber, column
+			size = 2
+		case char == '\'' || char == '"':
+			size = quotedLength(source)
+			if size == -1 {
+				a.report(file, SeverityError, lineNumber, column, codeUnterminatedQuote, "missing closing "+string(char))
+				size = strings.IndexByte(source, '\n')
+				if size == -1 {
+					size = len(source)
+				}
+			}
+			addToWord(source[:size])
+		case strings.ContainsRune(wordCharacters, char):
+			if char == '(' {
+				depth += 1
+			} else if char == ')' && depth > 0 {
+				depth -= 1
+			}
+			addToWord(string(char))
+		default:
+			if a.Strict {
+				a.report(file, SeverityError, lineNumber, column, codeUnexpectedCharacter, "unexpected character \""+string(char)+"\"")
+			} else {
+				a.report(file, SeverityWarning, lineNumber, column, codeIgnoredCharacter, "ignored unexpected character \""+string(char)+"\"")
+			}
+		}
+
+		for _, consumed := range source[:size] {
+			if consumed == '\n' {
+				lineNumber += 1
+				column = 1
+			} else {
+				column += 1
+			}
+		}
+		source = source[size:]
+	}
+	endLine()
+
+	if inBlockComment {
+		a.report(file, SeverityError, blockCommentLine, blockCommentColumn, codeUnterminatedComment, "unterminated comment")
+	}
+	return program
+}
+
+// joinOperands merges the tokens of line that are between the same commas,
+// groups holding the number of commas before each token. The labels and the
+// operation at the start of the line always stay alone, and so does the name
+// of a .macro, which is followed by its parameters.
+func joinOperands(line []Token, groups []int) []Token {
+	var first int = 0
+	for first < len(line) && strings.HasSuffix(line[first].Text, ":") {
+		first += 1
+	}
+	if first < len(line)-1 && line[first].Text == ".macro" {
+		first += 1
+	}
+	if first == len(line) {
+		return line
+	}
+	var joined []Token = append([]Token{}, line[:first+1]...)
+	for i := first + 1; i < len(line); i++ {
+		if i > first+1 && groups[i] == groups[i-1] {
+			joined[len(joined)-1].Text += " " + line[i].Text
+		} else {
+			joined = append(joined, line[i])
+		}
+	}
+	return joined
+}
+
+// expressionStart gives the index of the token starting the expression of the
+// directives whose last operand is always one expression, so that spaces never
+// split it : .if, .elif, .rept and the value of .equ. It gives -1 for the
+// other lines.
+func expressionStart(line []Token) int {
+	var first int = 0
+	for first < len(line) && strings.HasSuffix(line[first].Text, ":") {
+		first += 1
+	}
+	if first == len(line) {
+		return -1
+	}
+	switch line[first].Text {
+	case ".if", ".elif", ".rept":
+		return first + 1
+	case ".equ":
+		return first + 2
+	}
+	return -1
+}
+
+// quotedLength gives the length of the quoted text at the start of source,
+// quotes included, or -1 if it is not closed on the same line. A backslash
+// escapes the next character.
+func quotedLength(source string) int {
+	var quote uint8 = source[0]
+	for i := 1; i < len(source); i++ {
+		switch source[i] {
+		case '\\':
+			i += 1
+		case '\n':
+			return -1
+		case quote:
+			return i + 1
+		}
+	}
+	return -1
+}
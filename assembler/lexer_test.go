@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	var tests = []struct {
+		source string
+		lines  [][]string
+	}{
+		{"ADD R1 R2 ; comment\n", [][]string{{"ADD", "R1", "R2"}}},
+		{"// comment\n\nHLT\n", [][]string{{"HLT"}}},
+		{"MOV1B R1 /* a */ 2\n", [][]string{{"MOV1B", "R1", "2"}}},
+		{"/* a\nb */ HLT\n", [][]string{{"HLT"}}},
+		{"ADDIB R1, 2 + 3\n", [][]string{{"ADDIB", "R1", "2 + 3"}}},
+		{"ADDIB R1 (2 + 3)\n", [][]string{{"ADDIB", "R1", "(2 + 3)"}}},
+		{".ascii \"a ; b\"\n", [][]string{{".ascii", "\"a ; b\""}}},
+		{"loop: JMP loop\n", [][]string{{"loop:", "JMP", "loop"}}},
+	}
+	for _, test := range tests {
+		var a *Assembler = NewAssembler(false)
+		var lines [][]string
+		for _, line := range a.tokenize("test.vasm", test.source) {
+			var words []string
+			for _, token := range line {
+				words = append(words, token.Text)
+			}
+			lines = append(lines, words)
+		}
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.source, lines, test.lines)
+		}
+	}
+}
+
+func TestTokenizePositions(t *testing.T) {
+	var a *Assembler = NewAssembler(false)
+	var program [][]Token = a.tokenize("test.vasm", "HLT\n  ADD R1 R2\n")
+	var token Token = program[1][2]
+	if token.Text != "R2" || token.Line != 2 || token.Column != 10 {
+		t.Errorf("got %q at %d:%d, want \"R2\" at 2:10", token.Text, token.Line, token.Column)
+	}
+}
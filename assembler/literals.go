@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//////////////
+// LITERALS //
+//////////////
+
+// isNumberLiteral tells whether word looks like a number, so that a typo in a
+// number is reported as an invalid number rather than an unknown token.
+func isNumberLiteral(word string) bool {
+	if len(word) > 1 && word[0] == '-' {
+		word = word[1:]
+	}
+	return len(word) != 0 && (strings.ContainsRune("0123456789", rune(word[0])) || word[0] == '\'')
+}
+
+// parseNumber reads an integer literal, which can be :
+//
+//	123, 1_000_000      decimal
+//	0x7F, 0b1010, 0o17  hexadecimal, binary and octal
+//	'A', '\n', '\x41'   character
+//
+// each of them optionally preceded by "-". Digits can be separated by "_".
+// Values from -2^63 to 2^64-1 are accepted, the ones above 2^63-1 are
+// returned as their two's complement.
+func parseNumber(word string) (int64, error) {
+	var negative bool = false
+	if word != "" && word[0] == '-' {
+		negative = true
+		word = word[1:]
+	}
+
+	var value uint64
+	if word != "" && word[0] == '\'' {
+		if len(word) < 2 || word[len(word)-1] != '\'' {
+			return 0, errors.New("missing closing '")
+		}
+		chars, err := unescape(word[1 : len(word)-1])
+		if err != nil {
+			return 0, err
+		} else if len(chars) != 1 {
+			return 0, errors.New("a character literal must contain exactly one character")
+		}
+		value = uint64(chars[0])
+	} else {
+		var base int = 10
+		var digits string = word
+		if len(word) > 2 && word[0] == '0' {
+			switch word[1] {
+			case 'x', 'X':
+				base, digits = 16, word[2:]
+			case 'b', 'B':
+				base, digits = 2, word[2:]
+			case 'o', 'O':
+				base, digits = 8, word[2:]
+			}
+		}
+		if digits == "" || digits[0] == '_' || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+			return 0, errors.New("invalid number \"" + word + "\", \"_\" can only be used between digits")
+		}
+		number, err := strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), base, 64)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return 0, errors.New("number \"" + word + "\" does not fit in 64 bits")
+			}
+			return 0, errors.New("invalid number \"" + word + "\"")
+		}
+		value = number
+	}
+
+	if negative {
+		if value > 1<<63 {
+			return 0, errors.New("number \"-" + word + "\" does not fit in 64 bits")
+		}
+		return -int64(value), nil
+	}
+	return int64(value), nil
+}
+
+// unescape replaces the escape sequences of the text of a character or string
+// literal : \n, \t, \r, \0, \\, \', \" and \xNN.
+func unescape(text string) ([]uint8, error) {
+	var result []uint8
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			result = append(result, text[i])
+			continue
+		}
+		i += 1
+		if i == len(text) {
+			return nil, errors.New("unfinished escape sequence")
+		}
+		switch text[i] {
+		case 'n':
+			result = append(result, '\n')
+		case 't':
+			result = append(result, '\t')
+		case 'r':
+			result = append(result, '\r')
+		case '0':
+			result = append(result, 0)
+		case '\\', '\'', '"':
+			result = append(result, text[i])
+		case 'x':
+			if i+2 >= len(text) {
+				return nil, errors.New("\\x needs two hexadecimal digits")
+			}
+			hexa, err := strconv.ParseUint(text[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, errors.New("\\x needs two hexadecimal digits")
+			}
+			result = append(result, uint8(hexa))
+			i += 2
+		default:
+			return nil, errors.New("unknown escape sequence \\" + string(text[i]))
+		}
+	}
+	return result, nil
+}
+
+// rangeOf gives the smallest and the biggest value of the given kind, taken
+// either as signed or as unsigned, which is what a data directive accepts.
+// The range of an immediate operand is given by immediateRange.
+func rangeOf(kind string) (int64, int64) {
+	var bits uint
+	switch kind {
+	case "Int8":
+		bits = 8
+	case "Int16":
+		bits = 16
+	case "Int24":
+		bits = 24
+	case "Int32":
+		bits = 32
+	case "Displacement":
+		return -2048, 2047
+	default:
+		return -1 << 63, 1<<63 - 1
+	}
+	return -(1 << (bits - 1)), 1<<bits - 1
+}
+
+// signedImmediates are the operations whose immediate is sign-extended by the
+// VM, the immediate of the others is zero-extended.
+var signedImmediates []string = []string{"ADDIB", "ADDIW", "SUBIB", "SUBIW", "MULIB", "MULIW", "DIVIB", "DIVIW", "MODIB", "MODIW",
+	"PUSHIB", "PUSHIW", "PUSHIT", "JMPB", "JMPW", "JMPT", "CALLB", "CALLW", "CALLT"}
+
+// immediateRange gives the smallest and the biggest value of an immediate of
+// the given kind for operation : -128 to 127 for ADDIB but 0 to 255 for ANDIB.
+func immediateRange(operation string, kind string) (int64, int64) {
+	low, high := rangeOf(kind)
+	if kind == "Displacement" {
+		return low, high
+	} else if inList(signedImmediates, operation) {
+		return low, high >> 1
+	}
+	return 0, high
+}
+
+func fitsIn(value int64, kind string) bool {
+	low, high := rangeOf(kind)
+	return value >= low && value <= high
+}
@@ -9,11 +9,12 @@ import (
 )
 
 var commands = map[string]func([]string){
-	"--run":   runCommand,
-	"--check": checkCommand,
-	//"--emit":  testCommand,
-	//"--load":  loadCommand,
-	"--help": helpCommand,
+	"--run":     runCommand,
+	"--check":   checkCommand,
+	"--emit":    emitCommand,
+	"--symbols": symbolsCommand,
+	"--load":    loadCommand,
+	"--help":    helpCommand,
 }
 
 //////////
@@ -43,6 +44,9 @@ func strToInt(x string) int {
 }
 
 func isInt(x string) bool {
+	if x == "" || x == "-" {
+		return false
+	}
 	for _, char := range x[1:] {
 		if !(strings.Contains("0123456789", string(char))) {
 			return false
@@ -65,6 +69,10 @@ func inList(liste []string, item string) bool {
 	return false
 }
 
+func hasExtension(path string, extension string) bool {
+	return strings.HasSuffix(path, extension) && len(path) > len(extension)
+}
+
 func isPowerOfTwo(x int) bool {
 	return x >= 2 && (x&(x-1)) == 0
 }
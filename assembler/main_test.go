@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsInt(t *testing.T) {
+	var tests = map[string]bool{"0": true, "64": true, "-12": true, "": false, "-": false, "1a": false, "+1": false}
+	for text, want := range tests {
+		if got := isInt(text); got != want {
+			t.Errorf("isInt(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"strings"
+)
+
+//////////////////
+// PREPROCESSOR //
+//////////////////
+
+// macro is a .macro definition, Body holds its lines as they were written.
+type macro struct {
+	Name       Token
+	Parameters []string
+	Body       [][]Token
+}
+
+// Macros calling themselves are stopped after this many nested expansions.
+const maxExpansionDepth int = 64
+
+// .rept cannot repeat its block more than this.
+const maxRepetitions int64 = 1 << 16
+
+// The directives opening a block, with the directive closing it.
+var blockEnds map[string]string = map[string]string{".macro": ".endm", ".rept": ".endr", ".irp": ".endr", ".if": ".endif", ".ifdef": ".endif", ".ifndef": ".endif"}
+
+// preprocess expands the macros, the .rept, .irp and conditional blocks, and
+// the .include and .incbin of program. It
+// also defines the .equ constants, so that .rept can use them, but keeps
+// their lines so the expanded program can be printed and assembled again.
+func (a *Assembler) preprocess(program [][]Token, depth int) [][]Token {
+	var result [][]Token
+	for i := 0; i < len(program); i++ {
+		var line []Token = program[i]
+		if isLabel(line[0]) && len(line) > 1 {
+			result = append(result, line[:1])
+			line = line[1:]
+		}
+		var word string = line[0].Text
+		switch {
+		case word == ".equ":
+			a.defineConstant(line)
+			result = append(result, line)
+		case word == ".include":
+			result = append(result, a.include(line, depth)...)
+		case word == ".incbin":
+			result = append(result, a.incbin(line)...)
+		case blockEnds[word] != "":
+			var end int = blockEnd(program, i)
+			if end == -1 {
+				a.errorAt(line[0], codeUnterminatedBlock, "\""+word+"\" is never closed by \""+blockEnds[word]+"\"")
+				return result
+			}
+			var block [][]Token = program[i : end+1]
+			var body [][]Token = block[1 : len(block)-1]
+			i = end
+			switch word {
+			case ".macro":
+				a.defineMacro(line, body)
+			case ".rept":
+				result = append(result, a.expandRept(line, body, depth)...)
+			case ".irp":
+				result = append(result, a.expandIrp(line, body, depth)...)
+			default:
+				result = append(result, a.preprocess(a.chooseBranch(block), depth)...)
+			}
+		case word == ".error":
+			a.errorAt(line[0], codeUserError, a.userMessage(line))
+		case word == ".warning":
+			a.warningAt(line[0], codeUserWarning, a.userMessage(line))
+		case inList([]string{".endm", ".endr", ".elif", ".else", ".endif"}, word):
+			a.errorAt(line[0], codeUnexpectedDirective, "\""+word+"\" without a block to close")
+		default:
+			if m, ok := a.macros[word]; ok {
+				result = append(result, a.expandMacro(m, line, depth)...)
+			} else {
+				result = append(result, line)
+			}
+		}
+	}
+	return result
+}
+
+// blockEnd gives the index of the line closing the block opened at start, or
+// -1 if it is never closed. The blocks inside it are skipped.
+func blockEnd(program [][]Token, start int) int {
+	var expected []string = []string{blockEnds[firstWord(program[start])]}
+	for i := start + 1; i < len(program); i++ {
+		var word string = firstWord(program[i])
+		if blockEnds[word] != "" {
+			expected = append(expected, blockEnds[word])
+		} else if word == expected[len(expected)-1] {
+			expected = expected[:len(expected)-1]
+			if len(expected) == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+////////////
+// MACROS //
+////////////
+
+func (a *Assembler) defineMacro(line []Token, body [][]Token) {
+	if len(line) < 2 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "\".macro\" needs a name")
+		return
+	}
+	var name Token = line[1]
+	if !isIdentifier(name.Text) || inList(forbiddenLabels, name.Text) {
+		a.errorAt(name, codeForbiddenLabel, "forbidden macro name \""+name.Text+"\"")
+		return
+	} else if previous, ok := a.macros[name.Text]; ok {
+		a.errorAt(name, codeDuplicateSymbol, "macro \""+name.Text+"\" is already defined at line "+intToStr(previous.Name.Line))
+		return
+	}
+	var parameters []string
+	for _, parameter := range line[2:] {
+		if !isIdentifier(parameter.Text) || strings.Contains(parameter.Text, ".") {
+			a.errorAt(parameter, codeForbiddenLabel, "forbidden parameter name \""+parameter.Text+"\"")
+			return
+		} else if inList(parameters, parameter.Text) {
+			a.errorAt(parameter, codeDuplicateSymbol, "parameter \""+parameter.Text+"\" is already defined")
+			return
+		}
+		parameters = append(parameters, parameter.Text)
+	}
+	a.macros[name.Text] = macro{Name: name, Parameters: parameters, Body: body}
+}
+
+func (a *Assembler) expandMacro(m macro, line []Token, depth int) [][]Token {
+	var arguments []Token = line[1:]
+	if len(arguments) != len(m.Parameters) {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for macro \""+m.Name.Text+"\", expected "+intToStr(len(m.Parameters))+" but got "+intToStr(len(arguments)))
+		return nil
+	}
+	var substitutions map[string]string = make(map[string]string)
+	for i, parameter := range m.Parameters {
+		substitutions[parameter] = arguments[i].Text
+	}
+	return a.expand(m.Body, substitutions, line[0], depth)
+}
+
+/////////////////
+// REPETITIONS //
+/////////////////
+
+// expandRept handles ".rept count", which repeats its block count times.
+func (a *Assembler) expandRept(line []Token, body [][]Token, depth int) [][]Token {
+	if len(line) != 2 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \".rept\", expected 1 but got "+intToStr(len(line)-1))
+		return nil
+	}
+	count, ok := a.evaluate(line[1])
+	if !ok {
+		return nil
+	} else if count < 0 || count > maxRepetitions {
+		a.errorAt(line[1], codeImmediateTooBig, "\".rept\" can repeat its block from 0 to "+formatValue(maxRepetitions)+" times")
+		return nil
+	}
+	var result [][]Token
+	for range count {
+		result = append(result, a.expand(body, nil, line[0], depth)...)
+	}
+	return result
+}
+
+// expandIrp handles ".irp name, value1, value2...", which repeats its block
+// once for each value, with \name replaced by the value.
+func (a *Assembler) expandIrp(line []Token, body [][]Token, depth int) [][]Token {
+	if len(line) < 2 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "\".irp\" needs a name and its values")
+		return nil
+	} else if !isIdentifier(line[1].Text) || strings.Contains(line[1].Text, ".") {
+		a.errorAt(line[1], codeForbiddenLabel, "forbidden parameter name \""+line[1].Text+"\"")
+		return nil
+	}
+	var result [][]Token
+	for _, value := range line[2:] {
+		result = append(result, a.expand(body, map[string]string{line[1].Text: value.Text}, line[0], depth)...)
+	}
+	return result
+}
+
+////////////////////////
+// CONDITIONAL BLOCKS //
+////////////////////////
+
+// chooseBranch gives the lines of the first branch of the conditional block
+// whose condition is true, or nothing if none is. block goes from the .if,
+// .ifdef or .ifndef to the .endif, and its branches are separated by the
+// .elif and .else that are not inside a nested block.
+func (a *Assembler) chooseBranch(block [][]Token) [][]Token {
+	var headers []int = []int{0}
+	var expected []string
+	for i := 1; i < len(block)-1; i++ {
+		var word string = firstWord(block[i])
+		if blockEnds[word] != "" {
+			expected = append(expected, blockEnds[word])
+		} else if len(expected) != 0 && word == expected[len(expected)-1] {
+			expected = expected[:len(expected)-1]
+		} else if len(expected) == 0 && (word == ".elif" || word == ".else") {
+			if block[headers[len(headers)-1]][0].Text == ".else" {
+				a.errorAt(block[i][0], codeUnexpectedDirective, "\""+word+"\" after \".else\"")
+				return nil
+			}
+			headers = append(headers, i)
+		}
+	}
+	headers = append(headers, len(block)-1)
+
+	for j := 0; j < len(headers)-1; j++ {
+		if a.condition(block[headers[j]]) {
+			return block[headers[j]+1 : headers[j+1]]
+		}
+	}
+	return nil
+}
+
+// condition tells whether the branch starting at line is chosen : the value
+// of .if and .elif must not be 0, and the symbol of .ifdef and .ifndef must be
+// a constant or a macro, or not.
+func (a *Assembler) condition(line []Token) bool {
+	var word string = line[0].Text
+	if word == ".else" {
+		if len(line) != 1 {
+			a.errorAt(line[1], codeWrongNumberOfArgs, "\".else\" takes no argument")
+		}
+		return true
+	} else if len(line) != 2 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \""+word+"\", expected 1 but got "+intToStr(len(line)-1))
+		return false
+	}
+	if word == ".ifdef" || word == ".ifndef" {
+		_, isConstant := a.constants[line[1].Text]
+		_, isMacro := a.macros[line[1].Text]
+		return (isConstant || isMacro) == (word == ".ifdef")
+	}
+	value, ok := a.evaluate(line[1])
+	return ok && value != 0
+}
+
+// userMessage gives the message of .error and .warning, which is an optional
+// string.
+func (a *Assembler) userMessage(line []Token) string {
+	if len(line) == 1 {
+		return line[0].Text[1:] + " directive"
+	} else if len(line) > 2 {
+		a.errorAt(line[2], codeWrongNumberOfArgs, "\""+line[0].Text+"\" takes a single message")
+	}
+	message, err := stringLiteral(line[1].Text)
+	if err != nil {
+		a.errorAt(line[1], codeSyntaxError, err.Error())
+	}
+	return string(message)
+}
+
+///////////////
+// EXPANSION //
+///////////////
+
+// expand gives a copy of body with every \parameter replaced by its value, and
+// the labels defined in body renamed so each expansion has its own. The copied
+// tokens remember invocation, so errors inside them can show where the body
+// was expanded.
+func (a *Assembler) expand(body [][]Token, substitutions map[string]string, invocation Token, depth int) [][]Token {
+	if depth >= maxExpansionDepth {
+		a.errorAt(invocation, codeExpansionTooDeep, "more than "+intToStr(maxExpansionDepth)+" nested expansions, \""+invocation.Text+"\" probably expands itself")
+		return nil
+	}
+	a.expansions += 1
+	var renamed map[string]string = make(map[string]string)
+	for _, line := range body {
+		if isLabel(line[0]) {
+			var name string = line[0].Text[:len(line[0].Text)-1]
+			renamed[name] = name + "." + intToStr(a.expansions)
+		}
+	}
+
+	var result [][]Token
+	for _, line := range body {
+		var copied []Token
+		for _, token := range line {
+			token.Text = renameSymbols(substituteParameters(token.Text, substitutions), renamed)
+			token.Invocation = &invocation
+			copied = append(copied, token)
+		}
+		result = append(result, copied)
+	}
+	return a.preprocess(result, depth+1)
+}
+
+// substituteParameters replaces every \name of text by the value of name, the
+// unknown names are left untouched.
+func substituteParameters(text string, substitutions map[string]string) string {
+	if len(substitutions) == 0 || !strings.Contains(text, "\\") {
+		return text
+	}
+	var result strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' {
+			var end int = i + 1
+			for end < len(text) && isIdentifierCharacter(text[end]) && text[end] != '.' {
+				end += 1
+			}
+			if value, ok := substitutions[text[i+1:end]]; ok {
+				result.WriteString(value)
+				i = end - 1
+				continue
+			}
+		}
+		result.WriteByte(text[i])
+	}
+	return result.String()
+}
+
+// renameSymbols replaces the symbols of text that are keys of renamed, the
+// labels included, and leaves the numbers and the quoted text untouched.
+func renameSymbols(text string, renamed map[string]string) string {
+	if len(renamed) == 0 {
+		return text
+	}
+	var result strings.Builder
+	for i := 0; i < len(text); {
+		var end int = i + 1
+		if text[i] == '\'' || text[i] == '"' {
+			var size int = quotedLength(text[i:])
+			if size == -1 {
+				size = len(text) - i
+			}
+			end = i + size
+		} else if isIdentifierCharacter(text[i]) {
+			for end < len(text) && isIdentifierCharacter(text[end]) {
+				end += 1
+			}
+			if name, ok := renamed[text[i:end]]; ok && !isDigit(text[i]) {
+				result.WriteString(name)
+				i = end
+				continue
+			}
+		}
+		result.WriteString(text[i:end])
+		i = end
+	}
+	return result.String()
+}
+
+///////////
+// UTILS //
+///////////
+
+func isLabel(token Token) bool {
+	return strings.HasSuffix(token.Text, ":")
+}
+
+// firstWord gives the first word of line that is not a label.
+func firstWord(line []Token) string {
+	for _, token := range line {
+		if !isLabel(token) {
+			return token.Text
+		}
+	}
+	return ""
+}
+
+// formatLine gives the source of line, with commas between the operands and
+// without the spaces that would split an operand.
+func formatLine(line []Token) string {
+	if isLabel(line[0]) {
+		return line[0].Text
+	}
+	var operands []string
+	for _, token := range line[1:] {
+		operands = append(operands, compactOperand(token.Text))
+	}
+	var text string = "    " + line[0].Text
+	if len(operands) != 0 {
+		text += " " + strings.Join(operands, ", ")
+	}
+	return text
+}
+
+func compactOperand(text string) string {
+	var result strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\'' || text[i] == '"' {
+			var size int = quotedLength(text[i:])
+			if size == -1 {
+				size = len(text) - i
+			}
+			result.WriteString(text[i : i+size])
+			i += size - 1
+		} else if text[i] != ' ' {
+			result.WriteByte(text[i])
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+// .ifdef is true for the constants and the macros defined before it.
+func TestIfdef(t *testing.T) {
+	var tests = map[string]bool{
+		".equ X 1\n.ifdef X\nINCR R1\n.endif\nHLT\n":                    true,
+		".macro bump\nINCR R1\n.endm\n.ifdef bump\nbump\n.endif\nHLT\n": true,
+		".ifdef bump\nINCR R1\n.endif\n.macro bump\n.endm\nHLT\n":       false,
+		"start:\n.ifdef start\nINCR R1\n.endif\nHLT\n":                  false,
+	}
+	for source, kept := range tests {
+		_, file := assemble(t, source)
+		var size int = len(file.Sections[0].Content)
+		if kept != (size == 8) {
+			t.Errorf("%q assembled to %d bytes, want the block kept: %v", source, size, kept)
+		}
+	}
+}
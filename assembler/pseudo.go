@@ -0,0 +1,180 @@
+package main
+
+/////////////////////////
+// PSEUDO-INSTRUCTIONS //
+/////////////////////////
+
+// expandPseudoInstructions replaces the pseudo-instructions by real ones once
+// the program is preprocessed, so they show in the output of -E and their
+// instructions take room like any other when the labels are placed.
+func (a *Assembler) expandPseudoInstructions(program [][]Token) [][]Token {
+	var labels map[string]bool = make(map[string]bool)
+	for _, line := range program {
+		if isLabel(line[0]) {
+			labels[labelName(line[0])] = true
+		}
+	}
+	var result [][]Token
+	for _, line := range program {
+		if line[0].Text == "LI" {
+			result = append(result, a.loadImmediate(line, labels)...)
+		} else if line[0].Text == "SWITCH" {
+			result = append(result, a.switchTable(line, labels)...)
+		} else {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// loadImmediate expands `LI Rn, expression` into the shortest sequence giving
+// Rn the 64 bits value of expression : a CLEAR, then a MOVnB or a MOVnW for
+// every 16 bits word of the value that is not 0, MOVnB being enough when the
+// word fits in a byte. When no word is 0 the four MOVnW are enough.
+// The value of an expression using labels is not known yet, as the addresses
+// depend on the size of the program, so it always takes the four MOVnW.
+func (a *Assembler) loadImmediate(line []Token, labels map[string]bool) [][]Token {
+	if len(line) != 3 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \"LI\", expected 2 but got "+intToStr(len(line)-1))
+		return nil
+	}
+	var register, expression Token = line[1], line[2]
+	var result [][]Token
+	if a.usesLabels(expression.Text, labels, make(map[string]bool)) {
+		for n := 1; n <= 4; n++ {
+			var word string = "(" + expression.Text + ") & 0xFFFF"
+			if n > 1 {
+				word = "((" + expression.Text + ") >> " + intToStr(16*(n-1)) + ") & 0xFFFF"
+			}
+			result = append(result, pseudoLine(line, "MOV"+intToStr(n)+"W", register.Text, word))
+		}
+		return result
+	}
+
+	value, ok := a.evaluate(expression)
+	if !ok {
+		return nil
+	}
+	var words []uint64
+	var nonZero int = 0
+	for n := 0; n < 4; n++ {
+		words = append(words, uint64(value)>>(16*n)&0xFFFF)
+		if words[n] != 0 {
+			nonZero += 1
+		}
+	}
+	if nonZero < 4 {
+		result = append(result, pseudoLine(line, "CLEAR", register.Text))
+	}
+	for n, word := range words {
+		if word == 0 {
+			continue
+		}
+		var operation string = "MOV" + intToStr(n+1) + "W"
+		if word < 256 && nonZero < 4 {
+			operation = "MOV" + intToStr(n+1) + "B"
+		}
+		result = append(result, pseudoLine(line, operation, register.Text, intToStr(int(word))))
+	}
+	return result
+}
+
+// switchTable expands `SWITCH Rn, table, count`, which jumps to the address
+// number Rn of table, a list of .addr, when Rn is between 0 and count - 1 and
+// continues after the SWITCH otherwise. The computation needs a second
+// register, R14 (R13 when Rn is R14), which is kept on the stack. Rn holds the
+// address of the jump when it is taken.
+func (a *Assembler) switchTable(line []Token, labels map[string]bool) [][]Token {
+	if len(line) != 4 {
+		a.errorAt(line[0], codeWrongNumberOfArgs, "wrong number of args for \"SWITCH\", expected 3 but got "+intToStr(len(line)-1))
+		return nil
+	} else if !inList(registersName, line[1].Text) || line[1].Text == "R15" {
+		a.errorAt(line[1], codeSyntaxError, "syntax error, expected a Register other than R15 for \"SWITCH\"")
+		return nil
+	}
+	var index, table, count string = line[1].Text, line[2].Text, line[3].Text
+	var scratch string = "R14"
+	if index == "R14" {
+		scratch = "R13"
+	}
+	a.expansions += 1
+	var prefix string = "SWITCH." + intToStr(a.expansions) + "."
+
+	// The tokens remember the SWITCH like the ones of a macro, so its labels
+	// neither start a scope nor get reported as unused.
+	var invocation Token = line[0]
+	var at []Token
+	for _, token := range line {
+		token.Invocation = &invocation
+		at = append(at, token)
+	}
+	var result [][]Token = [][]Token{
+		pseudoLine(at, "PUSH", scratch),
+		pseudoLine(at, "CLEAR", scratch),
+		pseudoLine(at, "CMP", index, scratch, "L"),
+		pseudoLine(at, "JMP", prefix+"default"),
+	}
+	result = append(result, a.loadImmediate(pseudoLine([]Token{at[0], at[1], at[3]}, "LI", scratch, count), labels)...)
+	result = append(result, [][]Token{
+		pseudoLine(at, "CMP", index, scratch, "L"),
+		pseudoLine(at, "JMP", prefix+"jump"),
+		pseudoLine(at, prefix+"default:"),
+		pseudoLine(at, "POP", scratch),
+		pseudoLine(at, "JMP", prefix+"end"),
+		pseudoLine(at, prefix+"jump:"),
+		pseudoLine([]Token{at[0], at[1], at[2]}, "MOVL", scratch, table),
+		pseudoLine(at, "SHILI", index, "3"),
+		pseudoLine(at, "ADD", index, scratch),
+		pseudoLine(at, "READ", index, "@64", "*"+index),
+		pseudoLine(at, "POP", scratch),
+		pseudoLine(at, "JMPR", index),
+		pseudoLine(at, prefix+"end:"),
+	}...)
+	return result
+}
+
+// usesLabels tells whether the expression text refers to a label, directly or
+// through constants.
+func (a *Assembler) usesLabels(text string, labels map[string]bool, visited map[string]bool) bool {
+	for i := 0; i < len(text); {
+		var end int = i + 1
+		if text[i] == '\'' || text[i] == '"' {
+			var size int = quotedLength(text[i:])
+			if size == -1 {
+				return false
+			}
+			end = i + size
+		} else if isIdentifierCharacter(text[i]) {
+			for end < len(text) && isIdentifierCharacter(text[end]) {
+				end += 1
+			}
+			var word string = text[i:end]
+			if isDigit(word[0]) {
+				if len(word) > 1 && (word[len(word)-1] == 'b' || word[len(word)-1] == 'f') && labels[word[:len(word)-1]] {
+					return true
+				}
+			} else if constant, ok := a.constants[word]; ok && !visited[word] {
+				visited[word] = true
+				if a.usesLabels(constant.Text, labels, visited) {
+					return true
+				}
+			} else if labels[word] {
+				return true
+			}
+		}
+		i = end
+	}
+	return false
+}
+
+// pseudoLine gives the line made of words, each word being at the position
+// of the token of line it replaces.
+func pseudoLine(line []Token, words ...string) []Token {
+	var result []Token
+	for i, word := range words {
+		var token Token = line[min(i, len(line)-1)]
+		token.Text = word
+		result = append(result, token)
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package main
+
+//////////////
+// SECTIONS //
+//////////////
+
+// The assembler lays the sections out in RAM as follows :
+//
+//	0                          .text  instructions and read-only data
+//	end of .text (8 aligned)   .data  initialized data
+//	end of .data (8 aligned)   .bss   data initialized to 0
+//	end of .bss                       free memory
+//	RAMSize - RAMSize/4               stack, up to RAMSize
+//
+// Everything from the end of .text is writable, the stack included. A
+// section is aligned on its biggest .align if it is bigger than 8.
+
+var sectionNames []string = []string{".text", ".data", ".bss"}
+
+const sectionAlignment int = 8
+
+// sectionLayout is the position of the sections in RAM, computed once the
+// size of every section is known.
+type sectionLayout struct {
+	Bases map[string]int
+	Sizes map[string]int
+}
+
+func newSectionLayout(sizes map[string]int, alignments map[string]int) sectionLayout {
+	var layout sectionLayout = sectionLayout{Bases: make(map[string]int), Sizes: sizes}
+	var address int = 0
+	for _, name := range sectionNames {
+		var alignment int = max(sectionAlignment, alignments[name])
+		if name != ".text" {
+			address = alignTo(address, alignment)
+		}
+		layout.Bases[name] = address
+		address += sizes[name]
+	}
+	return layout
+}
+
+// checkSection reports the lines that cannot be in the current section : the
+// instructions must be in .text, and .bss can only hold .zero and .align as
+// its content is not stored in the .vbc file.
+func (a *Assembler) checkSection(line []Token, section string) {
+	var word string = line[0].Text
+	if section == ".data" && !inList(dataDirectives, word) {
+		a.errorAt(line[0], codeWrongSection, "\""+word+"\" cannot be in the .data section, instructions must be in .text")
+	} else if section == ".bss" && word != ".zero" && word != ".align" {
+		a.errorAt(line[0], codeWrongSection, "\""+word+"\" cannot be in the .bss section, only .zero and .align can")
+	}
+}
+
+// bytecodeFile gives the file holding the content of the sections, the empty
+// .data and .bss are left out.
+func (layout sectionLayout) bytecodeFile(contents map[string][]uint8) bytecodeFile {
+	var sections []section = []section{{Kind: sectionCode, Address: 0, Content: contents[".text"]}}
+	if layout.Sizes[".data"] != 0 {
+		sections = append(sections, section{Kind: sectionData, Address: uint32(layout.Bases[".data"]), Content: contents[".data"]})
+	}
+	if layout.Sizes[".bss"] != 0 {
+		sections = append(sections, section{Kind: sectionBss, Address: uint32(layout.Bases[".bss"]), Content: make([]uint8, layout.Sizes[".bss"])})
+	}
+	return newBytecodeFile(sections)
+}
+
+func alignTo(address int, alignment int) int {
+	return (address + alignment - 1) / alignment * alignment
+}
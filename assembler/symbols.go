@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//////////////////
+// SYMBOL TABLE //
+//////////////////
+
+// Symbol is a label of the program. Address is its exact byte address in RAM,
+// Scope is "Global", "Local" or "Anonymous" as given by scopeLabels, and
+// References counts the uses of the label in the source.
+type Symbol struct {
+	Name       string
+	Address    int
+	Section    string
+	Scope      string
+	Definition Token
+	References int
+	uses       map[string]bool
+}
+
+type SymbolTable struct {
+	symbols map[string]*Symbol
+}
+
+func newSymbolTable() SymbolTable {
+	return SymbolTable{symbols: make(map[string]*Symbol)}
+}
+
+// define adds symbol to the table, unless a symbol with the same name is
+// already defined, in which case it gives the first one and false.
+func (t SymbolTable) define(symbol Symbol) (Symbol, bool) {
+	if first, ok := t.symbols[symbol.Name]; ok {
+		return *first, false
+	}
+	symbol.uses = make(map[string]bool)
+	t.symbols[symbol.Name] = &symbol
+	return symbol, true
+}
+
+// reference gives the address of the symbol name and counts the reference,
+// use identifying where it is in the source so it is only counted once.
+func (t SymbolTable) reference(name string, use string) (int, bool) {
+	symbol, ok := t.symbols[name]
+	if !ok {
+		return 0, false
+	} else if !symbol.uses[use] {
+		symbol.uses[use] = true
+		symbol.References += 1
+	}
+	return symbol.Address, true
+}
+
+// Sorted gives the symbols by address, then by name.
+func (t SymbolTable) Sorted() []Symbol {
+	var symbols []Symbol
+	for _, symbol := range t.symbols {
+		symbols = append(symbols, *symbol)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Address != symbols[j].Address {
+			return symbols[i].Address < symbols[j].Address
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
+
+// MapFile gives the symbols as a text file with one symbol per line. The
+// anonymous labels are shown with their number.
+func (t SymbolTable) MapFile() string {
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("%-10s  %-7s  %-9s  %-10s  %-24s  %s\n", "address", "section", "scope", "references", "name", "defined at"))
+	for _, symbol := range t.Sorted() {
+		var name string = symbol.Name
+		if symbol.Scope == "Anonymous" {
+			// ".anonN.K" is the Kth anonymous label, named N in the source
+			name = strings.TrimPrefix(name[:strings.LastIndex(name, ".")], ".anon")
+		}
+		var definedAt string = filepath.Base(symbol.Definition.File) + ":" + intToStr(symbol.Definition.Line)
+		text.WriteString(fmt.Sprintf("0x%08X  %-7s  %-9s  %-10d  %-24s  %s\n", symbol.Address, symbol.Section, strings.ToLower(symbol.Scope), symbol.References, name, definedAt))
+	}
+	return text.String()
+}
+
+// reportUnusedSymbols warns about the labels that are never referenced. The
+// anonymous labels and the labels of expansions are left out, a macro often
+// defines a label that only some of its invocations use.
+func (a *Assembler) reportUnusedSymbols() {
+	for _, symbol := range a.Symbols.Sorted() {
+		var definition Token = symbol.Definition
+		if symbol.References != 0 || symbol.Scope == "Anonymous" || (definition.Invocation != nil && definition.Invocation.Text != ".include") {
+			continue
+		}
+		a.warningAt(definition, codeUnusedSymbol, "label \""+symbol.Name+"\" is never used")
+	}
+}
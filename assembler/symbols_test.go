@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+// A label is referenced once for every time it is written in the source,
+// however many instructions the line becomes.
+func TestReferences(t *testing.T) {
+	var tests = []struct {
+		source     string
+		references int
+	}{
+		{"LI R1, target\nMOVL R2, target\ntarget: HLT\n", 2},
+		{"JMP target\ntarget: .addr target, target\nHLT\n", 3},
+		{"SWITCH R1, target, 2\nHLT\ntarget: .addr next, next\nnext: HLT\n", 1},
+		{".macro go\nJMP target\n.endm\ngo\ngo\ntarget: HLT\n", 1},
+		{".equ far target + 4\nJMP far\nJMP far\ntarget: HLT\nHLT\n", 1},
+	}
+	for _, test := range tests {
+		a, _ := assemble(t, test.source)
+		if symbol := a.Symbols.symbols["target"]; symbol == nil || symbol.References != test.references {
+			t.Errorf("target of %q has %v, want %d references", test.source, symbol, test.references)
+		}
+	}
+}